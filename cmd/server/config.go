@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/username1366/prommerge"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration file. It is read as YAML, so JSON files are accepted as well.
+type Config struct {
+	// Listen is the address the server listens on
+	Listen     string           `yaml:"listen"`
+	Options    OptionsConfig    `yaml:"options"`
+	HTTPClient HTTPClientConfig `yaml:"http_client"`
+	Targets    []TargetConfig   `yaml:"targets"`
+	// FileSDConfigs discover further targets from files in the format of Prometheus file_sd_configs
+	FileSDConfigs []FileSDConfig `yaml:"file_sd_configs"`
+	// HTTPSDConfigs discover further targets from endpoints in the format of Prometheus http_sd_configs,
+	// the endpoints are requested with the http_client settings
+	HTTPSDConfigs []HTTPSDConfig `yaml:"http_sd_configs"`
+}
+
+// OptionsConfig holds the global merge options, see prommerge.PromDataOpts
+type OptionsConfig struct {
+	EmptyOnFailure    bool   `yaml:"empty_on_failure"`
+	Async             bool   `yaml:"async"`
+	Sort              bool   `yaml:"sort"`
+	OmitMeta          bool   `yaml:"omit_meta"`
+	SupressErrors     bool   `yaml:"supress_errors"`
+	StrictParsing     bool   `yaml:"strict_parsing"`
+	PreferProtobuf    bool   `yaml:"prefer_protobuf"`
+	PreferOpenMetrics bool   `yaml:"prefer_openmetrics"`
+	OmitTimestamps    bool   `yaml:"omit_timestamps"`
+	TargetMetrics     bool   `yaml:"target_metrics"`
+	ConflictPolicy    string `yaml:"conflict_policy"`
+	DuplicatePolicy   string `yaml:"duplicate_policy"`
+	// ScrapeInterval enables background scraping, targets are scraped on every request if it is zero
+	ScrapeInterval       time.Duration         `yaml:"scrape_interval"`
+	StalenessLimit       time.Duration         `yaml:"staleness_limit"`
+	MetricRelabelConfigs []RelabelConfigConfig `yaml:"metric_relabel_configs"`
+	MetricFilter         MetricFilterConfig    `yaml:"metric_filter"`
+}
+
+type HTTPClientConfig struct {
+	Timeout             time.Duration `yaml:"timeout"`
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DisableCompression  bool          `yaml:"disable_compression"`
+}
+
+type TargetConfig struct {
+	Name                 string `yaml:"name"`
+	URL                  string `yaml:"url"`
+	TargetSettingsConfig `yaml:",inline"`
+}
+
+// TargetSettingsConfig holds settings of a static target or of every target found by a discovery config
+type TargetSettingsConfig struct {
+	ExtraLabels          map[string]string     `yaml:"extra_labels"`
+	HonorLabels          bool                  `yaml:"honor_labels"`
+	ScrapePolicy         ScrapePolicyConfig    `yaml:"scrape_policy"`
+	MetricRelabelConfigs []RelabelConfigConfig `yaml:"metric_relabel_configs"`
+	MetricFilter         MetricFilterConfig    `yaml:"metric_filter"`
+}
+
+// FileSDConfig is a prommerge.FileDiscovery, labels of the discovered targets override extra_labels
+type FileSDConfig struct {
+	Files                []string      `yaml:"files"`
+	RefreshInterval      time.Duration `yaml:"refresh_interval"`
+	TargetSettingsConfig `yaml:",inline"`
+}
+
+// HTTPSDConfig is a prommerge.HTTPDiscovery, labels of the discovered targets override extra_labels
+type HTTPSDConfig struct {
+	URL                  string        `yaml:"url"`
+	RefreshInterval      time.Duration `yaml:"refresh_interval"`
+	TargetSettingsConfig `yaml:",inline"`
+}
+
+type ScrapePolicyConfig struct {
+	Timeout          time.Duration `yaml:"timeout"`
+	MaxRetries       int           `yaml:"max_retries"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff  time.Duration `yaml:"max_retry_backoff"`
+	RetryStatusCodes []int         `yaml:"retry_status_codes"`
+}
+
+// RelabelConfigConfig is a prommerge.RelabelConfig with the field names of Prometheus metric_relabel_configs
+type RelabelConfigConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+}
+
+type MetricFilterConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+var (
+	conflictPolicies = map[string]prommerge.ConflictPolicy{
+		"":            prommerge.ConflictPolicyFirstWins,
+		"first_wins":  prommerge.ConflictPolicyFirstWins,
+		"most_common": prommerge.ConflictPolicyMostCommon,
+		"error":       prommerge.ConflictPolicyError,
+		"rename":      prommerge.ConflictPolicyRename,
+	}
+	duplicatePolicies = map[string]prommerge.DuplicatePolicy{
+		"":           prommerge.DuplicatePolicyAllow,
+		"allow":      prommerge.DuplicatePolicyAllow,
+		"keep_first": prommerge.DuplicatePolicyKeepFirst,
+		"sum":        prommerge.DuplicatePolicySum,
+		"error":      prommerge.DuplicatePolicyError,
+	}
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// DefaultConfig returns the settings used for fields missing in the configuration file
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":9393",
+		Options: OptionsConfig{
+			Async:          true,
+			Sort:           true,
+			OmitMeta:       true,
+			StalenessLimit: 5 * time.Minute,
+		},
+		HTTPClient: HTTPClientConfig{
+			Timeout:             30 * time.Second,
+			MaxIdleConns:        500,
+			MaxIdleConnsPerHost: 200,
+			IdleConnTimeout:     30 * time.Second,
+			DisableCompression:  true,
+		},
+	}
+}
+
+// LoadConfig reads and validates the configuration file. Relative file_sd_configs paths are resolved
+// against the directory of the file, as Prometheus does.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config, %v", err)
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid config %v, %v", path, err)
+	}
+	for _, sd := range config.FileSDConfigs {
+		for i, file := range sd.Files {
+			if !filepath.IsAbs(file) {
+				sd.Files[i] = filepath.Join(filepath.Dir(path), file)
+			}
+		}
+	}
+	return config, nil
+}
+
+// ParseConfig decodes the configuration on top of DefaultConfig and validates it, unknown fields are rejected
+func ParseConfig(data []byte) (Config, error) {
+	config := DefaultConfig()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Validate checks every field, the error names the field path as it is written in the file
+func (c Config) Validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen: must not be empty")
+	}
+	if err := c.Options.validate("options"); err != nil {
+		return err
+	}
+	if c.HTTPClient.Timeout < 0 || c.HTTPClient.IdleConnTimeout < 0 || c.HTTPClient.MaxIdleConns < 0 || c.HTTPClient.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("http_client: timeouts and connection limits must not be negative")
+	}
+	if len(c.Targets) == 0 && len(c.FileSDConfigs) == 0 && len(c.HTTPSDConfigs) == 0 {
+		return fmt.Errorf("targets: at least one target or discovery config is required")
+	}
+	names := make(map[string]int)
+	for i, target := range c.Targets {
+		field := fmt.Sprintf("targets[%v]", i)
+		if err := target.validate(field); err != nil {
+			return err
+		}
+		if target.Name == "" {
+			continue
+		}
+		if j, ok := names[target.Name]; ok {
+			return fmt.Errorf("%v.name: %v is already used by targets[%v]", field, target.Name, j)
+		}
+		names[target.Name] = i
+	}
+	for i, sd := range c.FileSDConfigs {
+		if err := sd.validate(fmt.Sprintf("file_sd_configs[%v]", i)); err != nil {
+			return err
+		}
+	}
+	for i, sd := range c.HTTPSDConfigs {
+		if err := sd.validate(fmt.Sprintf("http_sd_configs[%v]", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o OptionsConfig) validate(field string) error {
+	if _, ok := conflictPolicies[o.ConflictPolicy]; !ok {
+		return fmt.Errorf("%v.conflict_policy: unknown policy %q", field, o.ConflictPolicy)
+	}
+	if _, ok := duplicatePolicies[o.DuplicatePolicy]; !ok {
+		return fmt.Errorf("%v.duplicate_policy: unknown policy %q", field, o.DuplicatePolicy)
+	}
+	if o.ScrapeInterval < 0 {
+		return fmt.Errorf("%v.scrape_interval: must not be negative", field)
+	}
+	if o.StalenessLimit < 0 {
+		return fmt.Errorf("%v.staleness_limit: must not be negative", field)
+	}
+	return validateRules(field, o.MetricRelabelConfigs, o.MetricFilter)
+}
+
+func (t TargetConfig) validate(field string) error {
+	if err := validateURL(field, t.URL); err != nil {
+		return err
+	}
+	return t.TargetSettingsConfig.validate(field)
+}
+
+func (sd HTTPSDConfig) validate(field string) error {
+	if err := validateURL(field, sd.URL); err != nil {
+		return err
+	}
+	if sd.RefreshInterval < 0 {
+		return fmt.Errorf("%v.refresh_interval: must not be negative", field)
+	}
+	return sd.TargetSettingsConfig.validate(field)
+}
+
+func validateURL(field, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if rawURL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%v.url: %q is not an http or https URL", field, rawURL)
+	}
+	return nil
+}
+
+func (sd FileSDConfig) validate(field string) error {
+	if len(sd.Files) == 0 {
+		return fmt.Errorf("%v.files: at least one file is required", field)
+	}
+	for i, pattern := range sd.Files {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%v.files[%v]: invalid pattern %q", field, i, pattern)
+		}
+	}
+	if sd.RefreshInterval < 0 {
+		return fmt.Errorf("%v.refresh_interval: must not be negative", field)
+	}
+	return sd.TargetSettingsConfig.validate(field)
+}
+
+func (t TargetSettingsConfig) validate(field string) error {
+	for name := range t.ExtraLabels {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("%v.extra_labels: invalid label name %q", field, name)
+		}
+	}
+	sp := t.ScrapePolicy
+	if sp.Timeout < 0 || sp.MaxRetries < 0 || sp.RetryBackoff < 0 || sp.MaxRetryBackoff < 0 {
+		return fmt.Errorf("%v.scrape_policy: durations and retries must not be negative", field)
+	}
+	for i, code := range sp.RetryStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("%v.scrape_policy.retry_status_codes[%v]: invalid status code %v", field, i, code)
+		}
+	}
+	return validateRules(field, t.MetricRelabelConfigs, t.MetricFilter)
+}
+
+func validateRules(field string, configs []RelabelConfigConfig, filter MetricFilterConfig) error {
+	for i, rc := range configs {
+		if err := rc.relabelConfig().Validate(); err != nil {
+			return fmt.Errorf("%v.metric_relabel_configs[%v]: %v", field, i, err)
+		}
+	}
+	if err := filter.metricFilter().Validate(); err != nil {
+		return fmt.Errorf("%v.metric_filter: %v", field, err)
+	}
+	return nil
+}
+
+func (rc RelabelConfigConfig) relabelConfig() prommerge.RelabelConfig {
+	return prommerge.RelabelConfig{
+		SourceLabels: rc.SourceLabels,
+		Separator:    rc.Separator,
+		Regex:        rc.Regex,
+		Modulus:      rc.Modulus,
+		TargetLabel:  rc.TargetLabel,
+		Replacement:  rc.Replacement,
+		Action:       prommerge.RelabelAction(rc.Action),
+	}
+}
+
+func relabelConfigs(configs []RelabelConfigConfig) []prommerge.RelabelConfig {
+	var result []prommerge.RelabelConfig
+	for _, rc := range configs {
+		result = append(result, rc.relabelConfig())
+	}
+	return result
+}
+
+func (mf MetricFilterConfig) metricFilter() prommerge.MetricFilter {
+	return prommerge.MetricFilter{Include: mf.Include, Exclude: mf.Exclude}
+}
+
+// PromDataOpts converts the global options, the HTTP client is built from HTTPClient
+func (c Config) PromDataOpts() prommerge.PromDataOpts {
+	o := c.Options
+	return prommerge.PromDataOpts{
+		EmptyOnFailure:       o.EmptyOnFailure,
+		Async:                o.Async,
+		Sort:                 o.Sort,
+		OmitMeta:             o.OmitMeta,
+		SupressErrors:        o.SupressErrors,
+		StrictParsing:        o.StrictParsing,
+		PreferProtobuf:       o.PreferProtobuf,
+		PreferOpenMetrics:    o.PreferOpenMetrics,
+		OmitTimestamps:       o.OmitTimestamps,
+		TargetMetrics:        o.TargetMetrics,
+		ConflictPolicy:       conflictPolicies[o.ConflictPolicy],
+		DuplicatePolicy:      duplicatePolicies[o.DuplicatePolicy],
+		MetricRelabelConfigs: relabelConfigs(o.MetricRelabelConfigs),
+		MetricFilter:         o.MetricFilter.metricFilter(),
+		ScrapeInterval:       o.ScrapeInterval,
+		StalenessLimit:       o.StalenessLimit,
+		HTTPClient: &http.Client{
+			Timeout: c.HTTPClient.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        c.HTTPClient.MaxIdleConns,
+				MaxIdleConnsPerHost: c.HTTPClient.MaxIdleConnsPerHost,
+				IdleConnTimeout:     c.HTTPClient.IdleConnTimeout,
+				DisableCompression:  c.HTTPClient.DisableCompression,
+			},
+		},
+	}
+}
+
+// PromTargets converts the static targets
+func (c Config) PromTargets() []prommerge.PromTarget {
+	targets := make([]prommerge.PromTarget, 0, len(c.Targets))
+	for _, t := range c.Targets {
+		target := t.promTarget()
+		target.Name, target.Url = t.Name, t.URL
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Discoverers converts the discovery configs, file_sd_configs first, client makes the http_sd_configs requests
+func (c Config) Discoverers(client *http.Client) []prommerge.Discoverer {
+	var discoverers []prommerge.Discoverer
+	for _, sd := range c.FileSDConfigs {
+		discoverers = append(discoverers, &prommerge.FileDiscovery{
+			Files:           sd.Files,
+			RefreshInterval: sd.RefreshInterval,
+			Template:        sd.promTarget(),
+		})
+	}
+	for _, sd := range c.HTTPSDConfigs {
+		discoverers = append(discoverers, &prommerge.HTTPDiscovery{
+			URL:             sd.URL,
+			RefreshInterval: sd.RefreshInterval,
+			HTTPClient:      client,
+			Template:        sd.promTarget(),
+		})
+	}
+	return discoverers
+}
+
+// discoveryKeys identify the discovery configs in the order of Discoverers
+func (c Config) discoveryKeys() []string {
+	var keys []string
+	for _, sd := range c.FileSDConfigs {
+		keys = append(keys, fmt.Sprintf("file_sd %+v", sd))
+	}
+	for _, sd := range c.HTTPSDConfigs {
+		keys = append(keys, fmt.Sprintf("http_sd %+v", sd))
+	}
+	return keys
+}
+
+// promTarget converts the settings into a target without name and URL
+func (t TargetSettingsConfig) promTarget() prommerge.PromTarget {
+	return prommerge.PromTarget{
+		ExtraLabels: prommerge.ExtraLabels(t.ExtraLabels),
+		HonorLabels: t.HonorLabels,
+		ScrapePolicy: prommerge.ScrapePolicy{
+			Timeout:          t.ScrapePolicy.Timeout,
+			MaxRetries:       t.ScrapePolicy.MaxRetries,
+			RetryBackoff:     t.ScrapePolicy.RetryBackoff,
+			MaxRetryBackoff:  t.ScrapePolicy.MaxRetryBackoff,
+			RetryStatusCodes: t.ScrapePolicy.RetryStatusCodes,
+		},
+		MetricRelabelConfigs: relabelConfigs(t.MetricRelabelConfigs),
+		MetricFilter:         t.MetricFilter.metricFilter(),
+	}
+}
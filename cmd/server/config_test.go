@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/username1366/prommerge"
+)
+
+func TestLoadConfigExample(t *testing.T) {
+	config, err := LoadConfig("config.example.yaml")
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	opts := config.PromDataOpts()
+	if opts.ScrapeInterval != 15*time.Second || opts.ConflictPolicy != prommerge.ConflictPolicyMostCommon || opts.DuplicatePolicy != prommerge.DuplicatePolicyKeepFirst || !opts.Async {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+	if opts.HTTPClient.Timeout != 30*time.Second {
+		t.Errorf("Receive %v client timeout; want 30s", opts.HTTPClient.Timeout)
+	}
+	targets := config.PromTargets()
+	if len(targets) != 2 {
+		t.Fatalf("Receive %v targets; want 2", len(targets))
+	}
+	if fmt.Sprint(targets[0].ExtraLabels) != `[app="api" env="prod"]` || targets[0].ScrapePolicy.MaxRetries != 2 {
+		t.Errorf("Unexpected target %+v", targets[0])
+	}
+	if !targets[1].HonorLabels || targets[1].MetricRelabelConfigs[0].Action != prommerge.RelabelDrop {
+		t.Errorf("Unexpected target %+v", targets[1])
+	}
+}
+
+func TestLoadConfigRelativeFiles(t *testing.T) {
+	dir := t.TempDir()
+	config := "file_sd_configs: [{files: [targets/*.json, " + filepath.Join(dir, "abs.yml") + "]}]"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o644); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	loaded, err := LoadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	files := loaded.Discoverers(nil)[0].(*prommerge.FileDiscovery).Files
+	if expected := []string{filepath.Join(dir, "targets", "*.json"), filepath.Join(dir, "abs.yml")}; fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Errorf("Receive %v; want %v", files, expected)
+	}
+}
+
+func TestParseConfigRelabelDefaults(t *testing.T) {
+	config, err := ParseConfig([]byte(`targets: [{url: "http://127.0.0.1:1/metrics", metric_relabel_configs: [{source_labels: [a], target_label: b}, {source_labels: [a, c], separator: "", target_label: b, replacement: ""}]}]`))
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	configs := config.PromTargets()[0].MetricRelabelConfigs
+	if configs[0].Separator != nil || configs[0].Replacement != nil {
+		t.Errorf("Receive %+v; want unset separator and replacement", configs[0])
+	}
+	if configs[1].Separator == nil || *configs[1].Separator != "" || configs[1].Replacement == nil || *configs[1].Replacement != "" {
+		t.Errorf("Receive %+v; want empty separator and replacement", configs[1])
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	config, err := ParseConfig([]byte(`{"listen": ":9000", "options": {"omit_meta": false}, "targets": [{"url": "http://127.0.0.1:1/metrics", "extra_labels": {"app": "a \"quoted\" app"}}]}`))
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	// Targets are scraped in the text format unless prefer_protobuf is set
+	if config.Listen != ":9000" || config.Options.OmitMeta || !config.Options.Sort || config.Options.PreferProtobuf {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	extraLabels := config.PromTargets()[0].ExtraLabels
+	if labels := prommerge.ExtraLabelList(extraLabels); fmt.Sprint(labels) != `[app a "quoted" app]` {
+		t.Errorf("Receive %v; want the quoted value back", labels)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for input, expected := range map[string]string{
+		"targets: []":                                            "targets: at least one target or discovery config is required",
+		"targets: [{url: ftp://host/metrics}]":                   "targets[0].url:",
+		"targets: [{url: http://a/m}, {url: 'http:///metrics'}]": "targets[1].url:",
+		"targets: [{url: http://a/m, extra_labels: {1a: x}}]":    `targets[0].extra_labels: invalid label name "1a"`,
+		"targets: [{url: http://a/m, metric_relabel_configs: [{regex: x, action: drop}, {regex: '(', action: drop}]}]": "targets[0].metric_relabel_configs[1]:",
+		"targets: [{url: http://a/m, metric_filter: {exclude: ['(']}}]":                                                "targets[0].metric_filter:",
+		"targets: [{url: http://a/m, scrape_policy: {retry_status_codes: [503, 1000]}}]":                               "targets[0].scrape_policy.retry_status_codes[1]:",
+		"targets: [{name: a, url: http://a/m}, {name: a, url: http://b/m}]":                                            "targets[1].name: a is already used by targets[0]",
+		"options: {conflict_policy: newest}\ntargets: [{url: http://a/m}]":                                             `options.conflict_policy: unknown policy "newest"`,
+		"options: {scrape_interval: 1 minute}\ntargets: [{url: http://a/m}]":                                           "line 1",
+		"http_sd_configs: [{url: inventory/targets}]":                                                                  "http_sd_configs[0].url:",
+		"file_sd_configs: [{refresh_interval: 1m}]":                                                                    "file_sd_configs[0].files: at least one file is required",
+		"file_sd_configs: [{files: ['[']}]":                                                                            "file_sd_configs[0].files[0]: invalid pattern",
+		"targets: [{url: http://a/m, labels: {a: b}}]":                                                                 "field labels not found",
+	} {
+		_, err := ParseConfig([]byte(input))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Receive %v for %q; want %v", err, input, expected)
+		}
+	}
+}
@@ -11,7 +11,7 @@ func Pyroscope() {
 		ApplicationName: "prommerge",
 
 		// replace this with the address of pyroscope server
-		ServerAddress: "http://127.1:4040",
+		ServerAddress: "http://127.0.0.1:4040",
 
 		// you can disable logging by setting this to nil
 		Logger: pyroscope.StandardLogger,
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/username1366/prommerge"
+)
+
+// Reloader applies the configuration file to the merger at startup and on every reload. An invalid
+// configuration is rejected and the merger keeps serving the previous one.
+type Reloader struct {
+	path   string
+	merger *prommerge.Merger
+
+	mu             sync.Mutex
+	config         Config
+	opts           prommerge.PromDataOpts
+	stopBackground context.CancelFunc
+	stopDiscovery  context.CancelFunc
+	// static targets of the configuration, followed by the targets of every discovery config in
+	// the merger. discoveryKeys identify discovery configs, those unchanged by a reload keep their
+	// targets until they are discovered again.
+	static        []prommerge.PromTarget
+	discovered    [][]prommerge.PromTarget
+	discoveryKeys []string
+	// httpDiscoveries are the running http_sd_configs, their status is exported by Collect
+	httpDiscoveries []*prommerge.HTTPDiscovery
+
+	lastReloadSuccessful prometheus.Gauge
+	lastReloadSuccess    prometheus.Gauge
+	reloads              *prometheus.CounterVec
+}
+
+// NewReloader loads the configuration from path, starts background scraping if it is configured and
+// registers the reload status metrics in registry
+func NewReloader(path string, registry prometheus.Registerer) (*Reloader, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reloader{
+		path:   path,
+		merger: prommerge.NewMerger(nil, prommerge.PromDataOpts{}),
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prommerge_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prommerge_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prommerge_config_reloads_total",
+			Help: "Number of configuration reload attempts by result.",
+		}, []string{"result"}),
+	}
+	for _, c := range []prometheus.Collector{r.lastReloadSuccessful, r.lastReloadSuccess, r.reloads, httpDiscoveryCollector{r}} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register reload metrics, %v", err)
+		}
+	}
+	r.apply(config)
+	return r, nil
+}
+
+func (r *Reloader) Merger() *prommerge.Merger {
+	return r.merger
+}
+
+// Config returns the configuration in use
+func (r *Reloader) Config() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// Reload reads the configuration file again and swaps targets and options of the merger. Collections
+// in flight finish with the previous configuration.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config, err := LoadConfig(r.path)
+	if err != nil {
+		r.lastReloadSuccessful.Set(0)
+		r.reloads.WithLabelValues("failure").Inc()
+		return err
+	}
+	if config.Listen != r.config.Listen {
+		slog.Warn("Listen address is changed, restart to apply it", slog.String("listen", r.config.Listen), slog.String("new", config.Listen))
+	}
+	r.applyLocked(config)
+	r.reloads.WithLabelValues("success").Inc()
+	slog.Info("Config is reloaded", slog.String("path", r.path), slog.Int("targets", len(config.Targets)))
+	return nil
+}
+
+func (r *Reloader) apply(config Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applyLocked(config)
+}
+
+// applyLocked updates the merger, restarts discovery and starts or stops background scraping as
+// the configuration says
+func (r *Reloader) applyLocked(config Config) {
+	if r.stopDiscovery != nil {
+		r.stopDiscovery()
+	}
+	keys := config.discoveryKeys()
+	discovered := make([][]prommerge.PromTarget, len(keys))
+	for i, key := range keys {
+		if j := slices.Index(r.discoveryKeys, key); j >= 0 {
+			discovered[i] = r.discovered[j]
+		}
+	}
+	r.static, r.discovered, r.discoveryKeys = config.PromTargets(), discovered, keys
+	r.opts = config.PromDataOpts()
+	r.merger.Update(r.targets(), r.opts)
+
+	var ctx context.Context
+	ctx, r.stopDiscovery = context.WithCancel(context.Background())
+	r.httpDiscoveries = nil
+	for i, d := range config.Discoverers(r.opts.HTTPClient) {
+		if hd, ok := d.(*prommerge.HTTPDiscovery); ok {
+			r.httpDiscoveries = append(r.httpDiscoveries, hd)
+		}
+		go r.discover(ctx, i, d)
+	}
+
+	switch {
+	case r.opts.ScrapeInterval > 0 && r.stopBackground == nil:
+		var ctx context.Context
+		ctx, r.stopBackground = context.WithCancel(context.Background())
+		go r.merger.Run(ctx)
+		slog.Info("Scrape targets in the background", slog.String("interval", r.opts.ScrapeInterval.String()))
+	case r.opts.ScrapeInterval == 0 && r.stopBackground != nil:
+		r.stopBackground()
+		r.stopBackground = nil
+		slog.Info("Scrape targets on every request")
+	}
+	r.config = config
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccess.Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// targets lists the static targets followed by the discovered ones
+func (r *Reloader) targets() []prommerge.PromTarget {
+	targets := slices.Clone(r.static)
+	for _, discovered := range r.discovered {
+		targets = append(targets, discovered...)
+	}
+	return targets
+}
+
+// discover runs the i-th discoverer of the configuration and updates the merger with every change
+// until ctx is canceled by the next reload
+func (r *Reloader) discover(ctx context.Context, i int, d prommerge.Discoverer) {
+	updates := make(chan []prommerge.PromTarget)
+	go d.Run(ctx, updates)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-updates:
+			r.mu.Lock()
+			if ctx.Err() == nil {
+				r.discovered[i] = targets
+				r.merger.Update(r.targets(), r.opts)
+				slog.Info("Targets are discovered", slog.String("discovery", r.discoveryKeys[i]), slog.Int("targets", len(targets)))
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// ServeHTTP reloads the configuration on POST /-/reload
+func (r *Reloader) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		slog.Error("Failed to reload config", slog.String("err", err.Error()))
+		http.Error(writer, fmt.Sprintf("failed to reload config, %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(writer, "config reloaded")
+}
+
+// WatchSignals reloads the configuration on every SIGHUP until ctx is done
+func (r *Reloader) WatchSignals(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				slog.Error("Failed to reload config", slog.String("err", err.Error()))
+			}
+		}
+	}
+}
+
+// Stop stops discovery and background scraping
+func (r *Reloader) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopDiscovery != nil {
+		r.stopDiscovery()
+	}
+	if r.stopBackground != nil {
+		r.stopBackground()
+		r.stopBackground = nil
+	}
+}
+
+var (
+	httpSDFailuresDesc = prometheus.NewDesc(
+		"prommerge_sd_http_failures_total",
+		"Number of failed refreshes of a http_sd_configs endpoint since the config was loaded.",
+		[]string{"config", "url"}, nil,
+	)
+	httpSDLastRefreshSuccessfulDesc = prometheus.NewDesc(
+		"prommerge_sd_http_last_refresh_successful",
+		"Whether the last refresh of a http_sd_configs endpoint was successful.",
+		[]string{"config", "url"}, nil,
+	)
+	httpSDTargetsDesc = prometheus.NewDesc(
+		"prommerge_sd_http_targets",
+		"Number of targets of the last successful refresh of a http_sd_configs endpoint.",
+		[]string{"config", "url"}, nil,
+	)
+)
+
+// httpDiscoveryCollector exports the refresh status of the running http_sd_configs
+type httpDiscoveryCollector struct {
+	r *Reloader
+}
+
+func (c httpDiscoveryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- httpSDFailuresDesc
+	ch <- httpSDLastRefreshSuccessfulDesc
+	ch <- httpSDTargetsDesc
+}
+
+func (c httpDiscoveryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.r.mu.Lock()
+	discoveries := slices.Clone(c.r.httpDiscoveries)
+	c.r.mu.Unlock()
+	for i, d := range discoveries {
+		status := d.Status()
+		labels := []string{fmt.Sprintf("http_sd_configs[%v]", i), d.URL}
+		successful := 0.0
+		if status.LastError == nil && !status.LastSuccess.IsZero() {
+			successful = 1
+		}
+		ch <- prometheus.MustNewConstMetric(httpSDFailuresDesc, prometheus.CounterValue, float64(status.Failures), labels...)
+		ch <- prometheus.MustNewConstMetric(httpSDLastRefreshSuccessfulDesc, prometheus.GaugeValue, successful, labels...)
+		ch <- prometheus.MustNewConstMetric(httpSDTargetsDesc, prometheus.GaugeValue, float64(status.Targets), labels...)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+	}
+	writeConfig("targets: [{name: a, url: http://127.0.0.1:1/metrics}]")
+
+	registry := prometheus.NewRegistry()
+	r, err := NewReloader(path, registry)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	defer r.Stop()
+	reload := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest(method, "/-/reload", nil))
+		return recorder
+	}
+
+	writeConfig("options: {scrape_interval: 1h, sort: false}\ntargets: [{name: a, url: http://127.0.0.1:1/metrics}, {name: b, url: http://127.0.0.1:2/metrics}]")
+	if recorder := reload(http.MethodPost); recorder.Code != http.StatusOK {
+		t.Fatalf("Receive %v %v; want 200", recorder.Code, recorder.Body.String())
+	}
+	if targets := r.Merger().Targets(); len(targets) != 2 || targets[1].Name != "b" {
+		t.Errorf("Receive targets %+v; want a and b", targets)
+	}
+	if opts := r.Merger().Options(); opts.Sort || opts.ScrapeInterval == 0 || r.stopBackground == nil {
+		t.Errorf("Receive options %+v; want the reloaded ones with background scraping", opts)
+	}
+
+	// An invalid config is rejected and the previous one is kept
+	writeConfig("targets: [{name: a, url: ftp://127.0.0.1:1/metrics}]")
+	recorder := reload(http.MethodPost)
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "targets[0].url") {
+		t.Errorf("Receive %v %v; want 500 naming the bad field", recorder.Code, recorder.Body.String())
+	}
+	if targets := r.Merger().Targets(); len(targets) != 2 {
+		t.Errorf("Receive targets %+v; want the previous ones", targets)
+	}
+	if value := testutil.ToFloat64(r.lastReloadSuccessful); value != 0 {
+		t.Errorf("Receive %v last reload successful; want 0", value)
+	}
+	if value := testutil.ToFloat64(r.reloads.WithLabelValues("failure")); value != 1 {
+		t.Errorf("Receive %v failed reloads; want 1", value)
+	}
+
+	writeConfig("targets: [{name: a, url: http://127.0.0.1:1/metrics}]")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if value := testutil.ToFloat64(r.lastReloadSuccessful); value != 1 {
+		t.Errorf("Receive %v last reload successful; want 1", value)
+	}
+	if r.stopBackground != nil {
+		t.Errorf("Background scraping is not stopped")
+	}
+	if recorder := reload(http.MethodGet); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Receive %v for GET; want 405", recorder.Code)
+	}
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 4 {
+		t.Errorf("Receive %v series, %v; want 4", n, err)
+	}
+}
+
+func TestReloadFileDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		tmp := filepath.Join(dir, name+".tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+	}
+	write("targets.json", `[{"targets": ["10.0.0.1:9100"], "labels": {"env": "prod"}}]`)
+	config := "targets: [{url: http://127.0.0.1:1/metrics}]\nfile_sd_configs: [{files: ['" + filepath.Join(dir, "*.json") + "'], refresh_interval: 10ms, extra_labels: {app: node, env: dev}}]"
+	write("config.yaml", config)
+
+	r, err := NewReloader(filepath.Join(dir, "config.yaml"), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	defer r.Stop()
+	waitTargets := func(expected string) {
+		t.Helper()
+		var output string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			var urls []string
+			for _, target := range r.Merger().Targets() {
+				urls = append(urls, fmt.Sprint(target.Url, target.ExtraLabels))
+			}
+			if output = strings.Join(urls, " "); output == expected {
+				return
+			}
+		}
+		t.Fatalf("Receive targets %v; want %v", output, expected)
+	}
+
+	waitTargets(`http://127.0.0.1:1/metrics[] http://10.0.0.1:9100/metrics[app="node" env="prod" instance="10.0.0.1:9100"]`)
+	write("targets.json", `[{"targets": ["10.0.0.2:9100"]}]`)
+	waitTargets(`http://127.0.0.1:1/metrics[] http://10.0.0.2:9100/metrics[app="node" env="dev" instance="10.0.0.2:9100"]`)
+
+	// Discovered targets survive a reload that keeps the discovery config
+	write("config.yaml", strings.Replace(config, "127.0.0.1:1", "127.0.0.1:2", 1))
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if targets := r.Merger().Targets(); len(targets) != 2 || targets[1].Url != "http://10.0.0.2:9100/metrics" {
+		t.Errorf("Receive targets %+v right after reload; want the discovered target kept", targets)
+	}
+
+	write("config.yaml", "targets: [{url: http://127.0.0.1:2/metrics}]")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	waitTargets(`http://127.0.0.1:2/metrics[]`)
+}
+
+func TestReloadHTTPDiscovery(t *testing.T) {
+	var failing atomic.Bool
+	inventory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "inventory is down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"targets": ["10.0.0.1:9100"], "labels": {"app": "node"}}]`)
+	}))
+	defer inventory.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("http_sd_configs: [{url: '"+inventory.URL+"', refresh_interval: 10ms}]"), 0o644); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	registry := prometheus.NewRegistry()
+	r, err := NewReloader(path, registry)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	defer r.Stop()
+	wait := func(condition func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if condition() {
+				return
+			}
+		}
+		t.Fatalf("Condition is not met")
+	}
+	metric := func(name string) float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		for _, f := range families {
+			if f.GetName() == name && len(f.GetMetric()) == 1 {
+				m := f.GetMetric()[0]
+				return m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			}
+		}
+		return -1
+	}
+
+	wait(func() bool { return len(r.Merger().Targets()) == 1 })
+	if target := r.Merger().Targets()[0]; target.Url != "http://10.0.0.1:9100/metrics" || fmt.Sprint(target.ExtraLabels) != `[app="node" instance="10.0.0.1:9100"]` {
+		t.Errorf("Unexpected target %+v", target)
+	}
+	wait(func() bool { return metric("prommerge_sd_http_last_refresh_successful") == 1 })
+
+	// The last good targets are kept while the endpoint fails
+	failing.Store(true)
+	wait(func() bool { return metric("prommerge_sd_http_failures_total") >= 2 })
+	if metric("prommerge_sd_http_last_refresh_successful") != 0 || metric("prommerge_sd_http_targets") != 1 {
+		t.Errorf("Unexpected refresh status metrics")
+	}
+	if targets := r.Merger().Targets(); len(targets) != 1 {
+		t.Errorf("Receive targets %+v; want the last good ones", targets)
+	}
+}
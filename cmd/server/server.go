@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"github.com/lmittmann/tint"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/username1366/prommerge"
 	"log/slog"
 	"net/http"
@@ -15,13 +20,12 @@ import (
 const (
 	BasePort       = 10000
 	NumPromTargets = 100
-	Socket         = ":9393"
 )
 
 func GetPromTargets() []prommerge.PromTarget {
 	var targets []prommerge.PromTarget
 	for i := 0; i < NumPromTargets; i++ {
-		url := fmt.Sprintf("http://127.1:%v/metrics", BasePort+i)
+		url := fmt.Sprintf("http://127.0.0.1:%v/metrics", BasePort+i)
 		socket := fmt.Sprintf(":%v", BasePort+i)
 		go func() {
 			slog.Error("HTTP server error", slog.String("err", http.ListenAndServe(socket, promhttp.Handler()).Error()))
@@ -41,7 +45,7 @@ func GetPromTargetsSingleServer() []prommerge.PromTarget {
 	go http.ListenAndServe("localhost:6060", nil)
 
 	for i := 0; i < NumPromTargets; i++ {
-		url := fmt.Sprintf("http://127.1:%v/metrics%v", BasePort, i)
+		url := fmt.Sprintf("http://127.0.0.1:%v/metrics%v", BasePort, i)
 		targets = append(targets, prommerge.PromTarget{
 			Url:         url,
 			ExtraLabels: []string{fmt.Sprintf("app=%v", i)},
@@ -51,6 +55,8 @@ func GetPromTargetsSingleServer() []prommerge.PromTarget {
 }
 
 func main() {
+	configFile := flag.String("config", "", "path to the YAML or JSON configuration file, local demo targets are served if empty")
+	flag.Parse()
 	//Pyroscope()
 	w := os.Stderr
 	// create a new logger
@@ -64,36 +70,66 @@ func main() {
 		}),
 	))
 
-	slog.Info("Listen server", slog.String("socket", Socket))
-	getTargetsTime := time.Now()
-	//targets := GetPromTargets()
-	targets := GetPromTargetsSingleServer()
-	httpClient := &http.Client{
-		Timeout: time.Second * 30, // Set a total timeout for the request
-		Transport: &http.Transport{
-			MaxIdleConns:        500,
-			IdleConnTimeout:     30 * time.Second,
-			DisableCompression:  true,
-			MaxIdleConnsPerHost: 200,
-		},
+	config := DefaultConfig()
+	registry := prometheus.NewRegistry()
+	var merger *prommerge.Merger
+	if *configFile != "" {
+		reloader, err := NewReloader(*configFile, registry)
+		if err != nil {
+			slog.Error("Failed to load config", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		config = reloader.Config()
+		merger = reloader.Merger()
+		http.Handle("/-/reload", reloader)
+		go reloader.WatchSignals(context.Background())
+	} else {
+		getTargetsTime := time.Now()
+		//targets := GetPromTargets()
+		targets := GetPromTargetsSingleServer()
+		slog.Info("Get targets generation is finished", slog.String("duration", time.Since(getTargetsTime).String()))
+		merger = prommerge.NewMerger(targets, config.PromDataOpts())
 	}
-	slog.Info("Get targets generation is finished", slog.String("duration", time.Since(getTargetsTime).String()))
-	http.HandleFunc("/prommerge", func(writer http.ResponseWriter, request *http.Request) {
-		t := time.Now()
-		pd := prommerge.NewPromData(targets, prommerge.PromDataOpts{
-			EmptyOnFailure: false,
-			Async:          true,
-			Sort:           true,
-			OmitMeta:       true,
-			SupressErrors:  false,
-			HTTPClient:     httpClient,
-		})
+	slog.Info("Listen server", slog.String("socket", config.Listen), slog.Int("targets", len(merger.Targets())))
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	http.HandleFunc("/prommerge", PrommergeHandler(merger, logger))
+	logger.Error("Listen error", slog.String("err", http.ListenAndServe(config.Listen, nil).Error()))
+}
 
-		err := pd.CollectTargets()
+// PrommergeHandler serves the merged metrics of the merger in the format negotiated from the Accept header,
+// the last snapshot is served if the merger scrapes in the background
+func PrommergeHandler(merger *prommerge.Merger, logger *slog.Logger) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		t := time.Now()
+		var pd *prommerge.PromData
+		var err error
+		if merger.Options().ScrapeInterval > 0 {
+			pd, err = merger.Snapshot()
+		} else {
+			pd, err = merger.Collect(request.Context())
+		}
 		if err != nil {
 			slog.Error("Failed to collect prometheus targets", slog.String("err", err.Error()))
 		}
-		output := pd.ToString()
+		format := expfmt.NegotiateIncludingOpenMetrics(request.Header)
+		switch format.FormatType() {
+		case expfmt.TypeProtoDelim:
+			writer.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+			buffer := bufio.NewWriter(writer)
+			err = pd.WriteProtobuf(buffer)
+			if err == nil {
+				err = buffer.Flush()
+			}
+		case expfmt.TypeOpenMetrics:
+			writer.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeOpenMetrics)))
+			_, err = pd.WriteOpenMetrics(writer)
+		default:
+			writer.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+			_, err = pd.WriteTo(writer)
+		}
+		if err != nil {
+			slog.Error("Failed to write output", slog.String("err", err.Error()))
+		}
 		logger.Info("Request processed",
 			slog.Duration("collect", pd.CollectTargetsDuration),
 			slog.Duration("sort", pd.SortDuration),
@@ -103,7 +139,5 @@ func main() {
 			slog.Duration("total_duration", time.Since(t)),
 			slog.Int("total_metrics", len(pd.PromMetrics)),
 		)
-		writer.Write([]byte(output))
-	})
-	logger.Error("Listen error", slog.String("err", http.ListenAndServe(Socket, nil).Error()))
+	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/username1366/prommerge"
+)
+
+func TestPrommergeHandler(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP jobs_total Jobs done.\n# TYPE jobs_total counter\njobs_total 3\n")
+	}))
+	defer target.Close()
+	merger := prommerge.NewMerger([]prommerge.PromTarget{
+		{Name: "a", Url: target.URL, ExtraLabels: []string{`app="a"`}},
+	}, prommerge.PromDataOpts{Sort: true})
+	handler := PrommergeHandler(merger, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	serve := func(accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/prommerge", nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Receive %v for Accept %q; want 200", recorder.Code, accept)
+		}
+		return recorder
+	}
+
+	for _, accept := range []string{"", prommerge.AcceptHeader} {
+		recorder := serve(accept)
+		body := recorder.Body.String()
+		if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") || !strings.Contains(body, "# TYPE jobs_total counter\njobs_total{app=\"a\"} 3\n") {
+			t.Errorf("Receive %v %v for Accept %q; want the text format", recorder.Header().Get("Content-Type"), body, accept)
+		}
+	}
+
+	recorder := serve(prommerge.OpenMetricsAcceptHeader)
+	body := recorder.Body.String()
+	if !prommerge.IsOpenMetrics(recorder.Header().Get("Content-Type")) || !strings.Contains(body, "# TYPE jobs counter\njobs_total{app=\"a\"} 3\n") || !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Receive %v %v; want the OpenMetrics format", recorder.Header().Get("Content-Type"), body)
+	}
+
+	recorder = serve(prommerge.ProtobufAcceptHeader)
+	if !prommerge.IsProtobuf(recorder.Header().Get("Content-Type")) {
+		t.Fatalf("Receive %v; want protobuf", recorder.Header().Get("Content-Type"))
+	}
+	decoder := expfmt.NewDecoder(recorder.Body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	var mf dto.MetricFamily
+	if err := decoder.Decode(&mf); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if mf.GetName() != "jobs_total" || mf.GetType() != dto.MetricType_COUNTER || len(mf.Metric) != 1 || mf.Metric[0].GetCounter().GetValue() != 3 {
+		t.Errorf("Unexpected metric family %v", &mf)
+	}
+}
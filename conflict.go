@@ -0,0 +1,152 @@
+package prommerge
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ConflictPolicy decides how families exposed by several targets with different HELP or TYPE are merged
+type ConflictPolicy int
+
+const (
+	// ConflictPolicyFirstWins merges all samples under the metadata of the first target in PromTargets order
+	ConflictPolicyFirstWins ConflictPolicy = iota
+	// ConflictPolicyMostCommon merges all samples under the metadata exposed by most targets, ties go to the
+	// first target in PromTargets order
+	ConflictPolicyMostCommon
+	// ConflictPolicyError drops conflicting families and makes the collection return *ConflictError
+	ConflictPolicyError
+	// ConflictPolicyRename keeps the family of the first target in PromTargets order as is and renames the others
+	// with a suffix derived from their target
+	ConflictPolicyRename
+)
+
+// MetadataConflict describes a family exposed by targets with different HELP or TYPE
+type MetadataConflict struct {
+	Name     string
+	Variants []FamilyMetadata
+}
+
+// FamilyMetadata is a variant of family metadata with the targets that exposed it. Renamed is the new
+// family name under ConflictPolicyRename, empty if the variant kept its name.
+type FamilyMetadata struct {
+	Help    string
+	Type    MetricType
+	Targets []string
+	Renamed string
+}
+
+// ConflictError is returned by a collection with ConflictPolicyError if targets disagree on family metadata
+type ConflictError struct {
+	Conflicts []MetadataConflict
+}
+
+func (e *ConflictError) Error() string {
+	var names []string
+	for _, conflict := range e.Conflicts {
+		names = append(names, conflict.Name)
+	}
+	return fmt.Sprintf("conflicting metadata for %v families: %v", len(names), strings.Join(names, ", "))
+}
+
+// resolveConflicts merges families with conflicting metadata according to ConflictPolicy
+// and records them in Conflicts
+func (pd *PromData) resolveConflicts() error {
+	var conflicts []MetadataConflict
+	drop := make(map[*MetricFamily]bool)
+	var renamed []*MetricFamily
+	for _, f := range pd.MetricFamilies {
+		variants := pd.familyIndex[f.Name]
+		if len(variants) < 2 || variants[0] != f {
+			continue
+		}
+		conflict := MetadataConflict{Name: f.Name}
+		for _, variant := range variants {
+			conflict.Variants = append(conflict.Variants, FamilyMetadata{Help: variant.Help, Type: variant.Type, Targets: variant.targets})
+		}
+
+		switch pd.ConflictPolicy {
+		case ConflictPolicyError:
+			for _, variant := range variants {
+				drop[variant] = true
+			}
+			delete(pd.familyIndex, f.Name)
+		case ConflictPolicyRename:
+			for i, variant := range variants[1:] {
+				name := renamedFamilyName(variant, i+1)
+				conflict.Variants[i+1].Renamed = name
+				for _, p := range variant.Metrics {
+					p.Name = name + strings.TrimPrefix(p.Name, variant.Name)
+				}
+				variant.Name = name
+				drop[variant] = true
+				renamed = append(renamed, variant)
+			}
+			pd.familyIndex[f.Name] = variants[:1]
+		default:
+			keep := variants[0]
+			if pd.ConflictPolicy == ConflictPolicyMostCommon {
+				for _, variant := range variants {
+					if len(variant.targets) > len(keep.targets) {
+						keep = variant
+					}
+				}
+			}
+			for _, variant := range variants {
+				if variant == keep {
+					continue
+				}
+				keep.Metrics = append(keep.Metrics, variant.Metrics...)
+				keep.targets = append(keep.targets, variant.targets...)
+				drop[variant] = true
+			}
+			pd.familyIndex[f.Name] = []*MetricFamily{keep}
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	families := pd.MetricFamilies[:0]
+	for _, f := range pd.MetricFamilies {
+		if !drop[f] {
+			families = append(families, f)
+		}
+	}
+	pd.MetricFamilies = families
+	for _, f := range renamed {
+		pd.mergeFamilies([]*MetricFamily{f})
+	}
+	pd.Conflicts = append(pd.Conflicts, conflicts...)
+	for _, conflict := range conflicts {
+		if !pd.SupressErrors {
+			slog.Warn("Conflicting family metadata", slog.String("name", conflict.Name), slog.Int("variants", len(conflict.Variants)))
+		}
+	}
+	if pd.ConflictPolicy == ConflictPolicyError {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// renamedFamilyName derives a new family name from the first target of the variant,
+// counters keep their _total suffix
+func renamedFamilyName(f *MetricFamily, n int) string {
+	suffix := fmt.Sprint(n)
+	if len(f.targets) > 0 {
+		suffix = strings.Map(func(r rune) rune {
+			if r < 128 && isLabelNameChar(byte(r), false) {
+				return r
+			}
+			return '_'
+		}, f.targets[0])
+	}
+	if f.Type == MetricTypeCounter {
+		if base, ok := strings.CutSuffix(f.Name, "_total"); ok {
+			return base + "_" + suffix + "_total"
+		}
+	}
+	return f.Name + "_" + suffix
+}
@@ -0,0 +1,137 @@
+package prommerge
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mergeTargets parses the expositions as if they were scraped from the named targets in order
+func mergeTargets(t *testing.T, pd *PromData, expositions map[string]string, order []string) {
+	for _, target := range order {
+		families, _, err := pd.parseMetricData(expositions[target], []string{fmt.Sprintf(`app="%v"`, target)}, nil)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		for _, f := range families {
+			f.targets = []string{target}
+		}
+		pd.mergeFamilies(families)
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	expositions := map[string]string{
+		"a": "# HELP jobs Jobs in queue.\n# TYPE jobs untyped\njobs 1\n",
+		"b": "# HELP jobs Queued jobs.\n# TYPE jobs gauge\njobs 2\n",
+		"c": "# TYPE jobs gauge\njobs 3\n",
+	}
+	order := []string{"a", "b", "c"}
+
+	for policy, expected := range map[ConflictPolicy]string{
+		ConflictPolicyFirstWins: "# HELP jobs Jobs in queue.\n# TYPE jobs untyped\n" +
+			"jobs{app=\"a\"} 1\njobs{app=\"b\"} 2\njobs{app=\"c\"} 3\n",
+		ConflictPolicyMostCommon: "# HELP jobs Queued jobs.\n# TYPE jobs gauge\n" +
+			"jobs{app=\"b\"} 2\njobs{app=\"c\"} 3\njobs{app=\"a\"} 1\n",
+		ConflictPolicyRename: "# HELP jobs Jobs in queue.\n# TYPE jobs untyped\njobs{app=\"a\"} 1\n" +
+			"# HELP jobs_b Queued jobs.\n# TYPE jobs_b gauge\njobs_b{app=\"b\"} 2\njobs_b{app=\"c\"} 3\n",
+		ConflictPolicyError: "",
+	} {
+		pd := NewPromData(nil, PromDataOpts{ConflictPolicy: policy, SupressErrors: true})
+		mergeTargets(t, pd, expositions, order)
+		err := pd.resolveConflicts()
+		pd.flattenFamilies()
+
+		var conflictErr *ConflictError
+		if policy == ConflictPolicyError && !errors.As(err, &conflictErr) {
+			t.Errorf("Receive %v for policy %v; want *ConflictError", err, policy)
+		}
+		if policy != ConflictPolicyError && err != nil {
+			t.Errorf("Receive %v for policy %v; want nil", err, policy)
+		}
+		if output := pd.ToString(); output != expected {
+			t.Errorf("Receive\n%v\nwant\n%v\nfor policy %v", output, expected, policy)
+		}
+		if len(pd.Conflicts) != 1 || len(pd.Conflicts[0].Variants) != 2 {
+			t.Fatalf("Receive conflicts %+v; want one with two variants", pd.Conflicts)
+		}
+		variant := pd.Conflicts[0].Variants[1]
+		if variant.Type != MetricTypeGauge || fmt.Sprint(variant.Targets) != "[b c]" {
+			t.Errorf("Unexpected conflict variant %+v", variant)
+		}
+		if policy == ConflictPolicyRename && variant.Renamed != "jobs_b" {
+			t.Errorf("Receive renamed %v; want jobs_b", variant.Renamed)
+		}
+	}
+}
+
+func TestConflictPolicyRenameCounter(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{ConflictPolicy: ConflictPolicyRename, SupressErrors: true})
+	mergeTargets(t, pd, map[string]string{
+		"api":      "# TYPE requests_total counter\nrequests_total 1\n",
+		"web-eu:1": "# TYPE requests_total untyped\nrequests_total 2\n",
+	}, []string{"api", "web-eu:1"})
+	if err := pd.resolveConflicts(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if len(pd.MetricFamilies) != 2 || pd.MetricFamilies[1].Name != "requests_total_web_eu_1" {
+		t.Errorf("Unexpected families %+v", pd.MetricFamilies)
+	}
+}
+
+func TestCollectConflictError(t *testing.T) {
+	var targets []PromTarget
+	for _, typ := range []string{"counter", "gauge"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# TYPE jobs %v\njobs 1\n# TYPE up gauge\nup 1\n", typ)
+		}))
+		defer server.Close()
+		targets = append(targets, PromTarget{Name: typ, Url: server.URL, ExtraLabels: []string{fmt.Sprintf(`app="%v"`, typ)}})
+	}
+
+	pd := NewPromData(targets, PromDataOpts{ConflictPolicy: ConflictPolicyError, Sort: true, SupressErrors: true})
+	err := pd.CollectTargets()
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || len(conflictErr.Conflicts) != 1 || conflictErr.Conflicts[0].Name != "jobs" {
+		t.Fatalf("Receive %v; want *ConflictError for jobs", err)
+	}
+	if output := pd.ToString(); strings.Contains(output, "jobs") || !strings.Contains(output, `up{app="counter"} 1`) {
+		t.Errorf("Unexpected output %v", output)
+	}
+}
+
+func TestConflictPolicyTargetOrder(t *testing.T) {
+	counter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "# HELP jobs Jobs done.\n# TYPE jobs counter\njobs 1\n")
+	}))
+	defer counter.Close()
+	gauge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# HELP jobs Jobs in queue.\n# TYPE jobs gauge\njobs 2\n")
+	}))
+	defer gauge.Close()
+	targets := []PromTarget{
+		{Name: "counter", Url: counter.URL, ExtraLabels: []string{`app="counter"`}},
+		{Name: "gauge", Url: gauge.URL, ExtraLabels: []string{`app="gauge"`}},
+	}
+
+	// The first target responds last, its metadata wins anyway and the second one is renamed
+	for policy, expected := range map[ConflictPolicy]string{
+		ConflictPolicyFirstWins:  "# HELP jobs Jobs done.\n# TYPE jobs counter\njobs{app=\"counter\"} 1\njobs{app=\"gauge\"} 2\n",
+		ConflictPolicyMostCommon: "# HELP jobs Jobs done.\n# TYPE jobs counter\njobs{app=\"counter\"} 1\njobs{app=\"gauge\"} 2\n",
+		ConflictPolicyRename: "# HELP jobs Jobs done.\n# TYPE jobs counter\njobs{app=\"counter\"} 1\n" +
+			"# HELP jobs_gauge Jobs in queue.\n# TYPE jobs_gauge gauge\njobs_gauge{app=\"gauge\"} 2\n",
+	} {
+		pd := NewPromData(targets, PromDataOpts{Async: true, ConflictPolicy: policy, SupressErrors: true})
+		if err := pd.CollectTargets(); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if output := pd.ToString(); output != expected {
+			t.Errorf("Receive\n%v\nwant\n%v\nfor policy %v", output, expected, policy)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package prommerge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRefreshInterval is used by FileDiscovery without RefreshInterval
+const DefaultRefreshInterval = 5 * time.Minute
+
+// Discoverer finds targets. Run sends the complete list of targets the discoverer knows about every time
+// it changes, the first list is sent as soon as it is known, and returns once ctx is done.
+type Discoverer interface {
+	Run(ctx context.Context, updates chan<- []PromTarget)
+}
+
+// TargetGroup is a group of targets sharing labels, in the format of Prometheus file_sd_configs
+// and http_sd_configs
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// PromTargets converts the group into targets based on template. Targets are host:port addresses scraped
+// over __scheme__ at __metrics_path__ with __param_<name> query parameters, http and /metrics by default,
+// full URLs are used as they are. The other labels become ExtraLabels, overriding template labels of the
+// same name, labels starting with __ are dropped and instance is set to the address unless it is given.
+func (g TargetGroup) PromTargets(template PromTarget) ([]PromTarget, error) {
+	var targets []PromTarget
+	for _, address := range g.Targets {
+		u, err := targetURL(address, g.Labels)
+		if err != nil {
+			return nil, err
+		}
+		labels := make(map[string]string)
+		labelList := ExtraLabelList(template.ExtraLabels)
+		for i := 0; i+1 < len(labelList); i += 2 {
+			labels[labelList[i]] = labelList[i+1]
+		}
+		for name, value := range g.Labels {
+			if !strings.HasPrefix(name, "__") {
+				labels[name] = value
+			}
+		}
+		if _, ok := labels["instance"]; !ok {
+			labels["instance"] = u.Host
+		}
+		for name := range labels {
+			if !isLabelName(name) {
+				return nil, fmt.Errorf("invalid label name %q of target %v", name, address)
+			}
+		}
+		target := template
+		target.Name = ""
+		target.Url = u.String()
+		target.ExtraLabels = ExtraLabels(labels)
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func targetURL(address string, labels map[string]string) (*url.URL, error) {
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid target %q", address)
+		}
+		return u, nil
+	}
+	if address == "" || strings.ContainsAny(address, "/?#") {
+		return nil, fmt.Errorf("invalid target address %q", address)
+	}
+	u := &url.URL{Scheme: labels["__scheme__"], Host: address, Path: labels["__metrics_path__"]}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Path == "" {
+		u.Path = "/metrics"
+	}
+	params := url.Values{}
+	for name, value := range labels {
+		if param, ok := strings.CutPrefix(name, "__param_"); ok {
+			params.Set(param, value)
+		}
+	}
+	u.RawQuery = params.Encode()
+	return u, nil
+}
+
+// FileDiscovery reads targets from files in the format of Prometheus file_sd_configs. The files are
+// polled, so they may be replaced by renaming as deployment tools usually do.
+type FileDiscovery struct {
+	// Files are paths of JSON or YAML files, told apart by the .json, .yml and .yaml extensions,
+	// the last path element may be a glob pattern
+	Files []string
+	// RefreshInterval is the pause between reads of the files, DefaultRefreshInterval if zero
+	RefreshInterval time.Duration
+	// Template is the base of every discovered target, see TargetGroup.PromTargets
+	Template PromTarget
+}
+
+// Run reads the files every RefreshInterval and sends the targets whenever they change. A file that
+// fails to read or parse keeps the targets it had, a removed file drops them.
+func (d *FileDiscovery) Run(ctx context.Context, updates chan<- []PromTarget) {
+	interval := d.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	known := make(map[string][]PromTarget)
+	var sent []PromTarget
+	first := true
+	for {
+		targets := d.refresh(known)
+		if first || !sameTargets(targets, sent) {
+			select {
+			case updates <- targets:
+				sent, first = targets, false
+			case <-ctx.Done():
+				return
+			}
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh reads the files into known, keyed by path, and returns their targets in path order
+func (d *FileDiscovery) refresh(known map[string][]PromTarget) []PromTarget {
+	seen := make(map[string]bool)
+	for _, pattern := range d.Files {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			slog.Error("Invalid target file pattern", slog.String("pattern", pattern), slog.String("err", err.Error()))
+			continue
+		}
+		for _, path := range paths {
+			seen[path] = true
+			targets, err := d.readFile(path)
+			if err != nil {
+				slog.Error("Failed to read target file, its previous targets are kept", slog.String("path", path), slog.String("err", err.Error()))
+				continue
+			}
+			known[path] = targets
+		}
+	}
+
+	paths := make([]string, 0, len(known))
+	for path := range known {
+		if !seen[path] {
+			delete(known, path)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	var targets []PromTarget
+	for _, path := range paths {
+		targets = append(targets, known[path]...)
+	}
+	return targets
+}
+
+func (d *FileDiscovery) readFile(path string) ([]PromTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []TargetGroup
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		err = json.Unmarshal(data, &groups)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &groups)
+	default:
+		return nil, fmt.Errorf("unknown target file extension %v", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v, %v", path, err)
+	}
+	return targetGroupsToPromTargets(groups, d.Template)
+}
+
+func targetGroupsToPromTargets(groups []TargetGroup, template PromTarget) ([]PromTarget, error) {
+	var targets []PromTarget
+	for i, g := range groups {
+		groupTargets, err := g.PromTargets(template)
+		if err != nil {
+			return nil, fmt.Errorf("target group %v: %v", i, err)
+		}
+		targets = append(targets, groupTargets...)
+	}
+	return targets, nil
+}
+
+// sameTargets compares targets made from the same template
+func sameTargets(a, b []PromTarget) bool {
+	return slices.EqualFunc(a, b, func(x, y PromTarget) bool {
+		return x.Url == y.Url && slices.Equal(x.ExtraLabels, y.ExtraLabels)
+	})
+}
+
+// DefaultHTTPRefreshInterval is used by HTTPDiscovery without RefreshInterval, as in Prometheus http_sd_configs
+const DefaultHTTPRefreshInterval = time.Minute
+
+// HTTPDiscovery polls an endpoint serving a JSON list of target groups, as Prometheus http_sd_configs do
+type HTTPDiscovery struct {
+	URL string
+	// RefreshInterval is the pause between requests and the timeout of each, DefaultHTTPRefreshInterval if zero
+	RefreshInterval time.Duration
+	// HTTPClient makes the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Template is the base of every discovered target, see TargetGroup.PromTargets
+	Template PromTarget
+
+	mu     sync.Mutex
+	status HTTPDiscoveryStatus
+}
+
+// HTTPDiscoveryStatus describes the refreshes of an HTTPDiscovery
+type HTTPDiscoveryStatus struct {
+	// Failures counts failed refreshes, the targets of the last successful one are kept meanwhile
+	Failures int
+	// LastError is the error of the last refresh, nil if it succeeded
+	LastError error
+	// LastSuccess is the time of the last successful refresh, zero if there was none
+	LastSuccess time.Time
+	// Targets is the number of targets of the last successful refresh
+	Targets int
+}
+
+// Status returns the refresh status, it is safe to call while Run is running
+func (d *HTTPDiscovery) Status() HTTPDiscoveryStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// Run requests the endpoint every RefreshInterval and sends the targets whenever they change.
+// Nothing is sent until the first successful refresh, a failed one keeps the targets sent before.
+func (d *HTTPDiscovery) Run(ctx context.Context, updates chan<- []PromTarget) {
+	interval := d.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultHTTPRefreshInterval
+	}
+	var sent []PromTarget
+	first := true
+	for {
+		targets, err := d.refresh(ctx, interval)
+		if ctx.Err() != nil {
+			return
+		}
+		d.mu.Lock()
+		d.status.LastError = err
+		if err != nil {
+			d.status.Failures++
+		} else {
+			d.status.LastSuccess, d.status.Targets = time.Now(), len(targets)
+		}
+		d.mu.Unlock()
+
+		if err != nil {
+			slog.Error("Failed to refresh targets, the previous targets are kept", slog.String("url", d.URL), slog.String("err", err.Error()))
+		} else if first || !sameTargets(targets, sent) {
+			select {
+			case updates <- targets:
+				sent, first = targets, false
+			case <-ctx.Done():
+				return
+			}
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (d *HTTPDiscovery) refresh(ctx context.Context, timeout time.Duration) ([]PromTarget, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request error for %s: %v", d.URL, err)
+	}
+	request.Header.Set("Accept", "application/json")
+	client := d.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("http get error for %s: %v", d.URL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http get failed for %s, response code expected 200, actual %v", d.URL, response.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil, fmt.Errorf("unexpected content type %q of %s, want application/json", response.Header.Get("Content-Type"), d.URL)
+	}
+	var groups []TargetGroup
+	if err := json.NewDecoder(response.Body).Decode(&groups); err != nil {
+		return nil, fmt.Errorf("failed to decode target groups of %s, %v", d.URL, err)
+	}
+	return targetGroupsToPromTargets(groups, d.Template)
+}
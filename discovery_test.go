@@ -0,0 +1,178 @@
+package prommerge
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTargetGroupPromTargets(t *testing.T) {
+	g := TargetGroup{
+		Targets: []string{"10.0.0.1:9100", "https://10.0.0.2:8443/custom?x=1"},
+		Labels: map[string]string{
+			"env":              "prod",
+			"app":              "node",
+			"__scheme__":       "https",
+			"__metrics_path__": "/probe",
+			"__param_module":   "http_2xx",
+			"__meta_zone":      "eu",
+		},
+	}
+	template := PromTarget{Name: "template", ExtraLabels: []string{`app="default"`, `team="infra"`}, HonorLabels: true}
+	targets, err := g.PromTargets(template)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	for i, expected := range []string{
+		`https://10.0.0.1:9100/probe?module=http_2xx [app="node" env="prod" instance="10.0.0.1:9100" team="infra"] true`,
+		`https://10.0.0.2:8443/custom?x=1 [app="node" env="prod" instance="10.0.0.2:8443" team="infra"] true`,
+	} {
+		if output := fmt.Sprint(targets[i].Url, " ", targets[i].ExtraLabels, " ", targets[i].HonorLabels); output != expected || targets[i].Name != "" {
+			t.Errorf("Receive %v; want %v", output, expected)
+		}
+	}
+
+	for _, g := range []TargetGroup{
+		{Targets: []string{"host:80/metrics"}},
+		{Targets: []string{""}},
+		{Targets: []string{"host:80"}, Labels: map[string]string{"bad-label": "x"}},
+	} {
+		if _, err := g.PromTargets(PromTarget{}); err == nil {
+			t.Errorf("Receive nil error for %+v", g)
+		}
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir := t.TempDir()
+	// Files are replaced by renaming, so the discovery never reads them half written
+	write := func(name, content string) {
+		t.Helper()
+		tmp := filepath.Join(dir, name+".tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+	}
+	write("a.json", `[{"targets": ["a:1"], "labels": {"app": "a"}}]`)
+	write("b.yml", "- targets: [b:1, b:2]\n  labels: {app: b}\n")
+	write("c.txt", "ignored, does not match the pattern")
+
+	d := &FileDiscovery{Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}, RefreshInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []PromTarget)
+	go d.Run(ctx, updates)
+	receive := func() string {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			var urls []string
+			for _, target := range targets {
+				urls = append(urls, target.Url)
+			}
+			return fmt.Sprint(urls)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No target update")
+			return ""
+		}
+	}
+
+	if urls := receive(); urls != "[http://a:1/metrics http://b:1/metrics http://b:2/metrics]" {
+		t.Errorf("Receive %v; want targets of both files", urls)
+	}
+	// A broken file keeps its targets, so nothing changes until it is fixed
+	write("a.json", `[{"targets": [`)
+	write("b.yml", "- targets: [b:1]\n")
+	if urls := receive(); urls != "[http://a:1/metrics http://b:1/metrics]" {
+		t.Errorf("Receive %v; want a kept and b updated", urls)
+	}
+	if err := os.Remove(filepath.Join(dir, "a.json")); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if urls := receive(); urls != "[http://b:1/metrics]" {
+		t.Errorf("Receive %v; want the removed file dropped", urls)
+	}
+}
+
+func TestHTTPDiscovery(t *testing.T) {
+	var mu sync.Mutex
+	status, body := http.StatusOK, `[{"targets": ["a:1", "b:1"], "labels": {"__metrics_path__": "/federate", "env": "prod"}}]`
+	inventory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	defer inventory.Close()
+	respond := func(code int, content string) {
+		mu.Lock()
+		defer mu.Unlock()
+		status, body = code, content
+	}
+
+	d := &HTTPDiscovery{URL: inventory.URL, RefreshInterval: 100 * time.Millisecond, Template: PromTarget{HonorLabels: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []PromTarget)
+	go d.Run(ctx, updates)
+	receive := func() []PromTarget {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No target update")
+			return nil
+		}
+	}
+
+	targets := receive()
+	if len(targets) != 2 || targets[1].Url != "http://b:1/federate" || fmt.Sprint(targets[1].ExtraLabels) != `[env="prod" instance="b:1"]` || !targets[1].HonorLabels {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+	if s := d.Status(); s.Failures != 0 || s.LastError != nil || s.Targets != 2 || s.LastSuccess.IsZero() {
+		t.Errorf("Unexpected status %+v", s)
+	}
+
+	// Failed refreshes are counted and keep the previous targets
+	for _, failure := range []struct {
+		code    int
+		content string
+	}{
+		{http.StatusInternalServerError, "inventory is down"},
+		{http.StatusOK, `[{"targets": `},
+		{http.StatusOK, `[{"targets": ["a:1/metrics"]}]`},
+	} {
+		respond(failure.code, failure.content)
+		deadline := time.Now().Add(5 * time.Second)
+		for failures := d.Status().Failures; d.Status().Failures == failures && time.Now().Before(deadline); {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if s := d.Status(); s.LastError == nil || s.Targets != 2 {
+			t.Errorf("Unexpected status %+v after %+v", s, failure)
+		}
+	}
+	select {
+	case targets := <-updates:
+		t.Errorf("Receive targets %+v after failed refreshes; want none", targets)
+	default:
+	}
+
+	respond(http.StatusOK, `[]`)
+	if targets := receive(); len(targets) != 0 {
+		t.Errorf("Receive %+v; want no targets", targets)
+	}
+	if s := d.Status(); s.LastError != nil || s.Failures < 3 {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
@@ -0,0 +1,102 @@
+package prommerge
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DuplicatePolicy decides what happens to identical series exposed by several targets,
+// which Prometheus rejects with a duplicate sample error
+type DuplicatePolicy int
+
+const (
+	// DuplicatePolicyAllow skips duplicate detection and writes every sample
+	DuplicatePolicyAllow DuplicatePolicy = iota
+	// DuplicatePolicyKeepFirst keeps the sample of the first target in PromTargets order and drops the later ones
+	DuplicatePolicyKeepFirst
+	// DuplicatePolicySum adds values of duplicate counter samples up, other samples are kept as with DuplicatePolicyKeepFirst
+	DuplicatePolicySum
+	// DuplicatePolicyError keeps the first sample and makes the collection return *DuplicateSeriesError
+	DuplicatePolicyError
+)
+
+// DuplicateSeries describes a series exposed more than once, Targets lists every target that exposed it
+type DuplicateSeries struct {
+	Name      string
+	LabelList []string
+	Targets   []string
+}
+
+// DuplicateSeriesError is returned by a collection with DuplicatePolicyError if targets expose identical series
+type DuplicateSeriesError struct {
+	Duplicates []DuplicateSeries
+}
+
+func (e *DuplicateSeriesError) Error() string {
+	var series []string
+	for _, d := range e.Duplicates {
+		series = append(series, fmt.Sprintf("%v%v from %v", d.Name, FormatLabels(d.LabelList), strings.Join(d.Targets, ", ")))
+	}
+	return fmt.Sprintf("%v duplicate series: %v", len(series), strings.Join(series, "; "))
+}
+
+// dedupSeries finds samples with identical name and labels according to DuplicatePolicy
+// and records them in Duplicates
+func (pd *PromData) dedupSeries() error {
+	if pd.DuplicatePolicy == DuplicatePolicyAllow {
+		return nil
+	}
+	var duplicates []DuplicateSeries
+	for _, f := range pd.MetricFamilies {
+		first := make(map[string]*PromMetric, len(f.Metrics))
+		index := make(map[string]int)
+		metrics := f.Metrics[:0]
+		for _, p := range f.Metrics {
+			key := seriesID(p)
+			kept := first[key]
+			if kept == nil {
+				first[key] = p
+				metrics = append(metrics, p)
+				continue
+			}
+			if pd.DuplicatePolicy == DuplicatePolicySum && f.Type == MetricTypeCounter {
+				kept.Value += p.Value
+			}
+			i, ok := index[key]
+			if !ok {
+				i = len(duplicates)
+				index[key] = i
+				duplicates = append(duplicates, DuplicateSeries{Name: kept.Name, LabelList: kept.LabelList, Targets: []string{kept.target}})
+			}
+			if !slices.Contains(duplicates[i].Targets, p.target) {
+				duplicates[i].Targets = append(duplicates[i].Targets, p.target)
+			}
+		}
+		f.Metrics = metrics
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	pd.Duplicates = append(pd.Duplicates, duplicates...)
+	if !pd.SupressErrors {
+		slog.Warn("Duplicate series", slog.Int("count", len(duplicates)))
+	}
+	if pd.DuplicatePolicy == DuplicatePolicyError {
+		return &DuplicateSeriesError{Duplicates: duplicates}
+	}
+	return nil
+}
+
+// seriesID identifies a series by its name and label set regardless of the label order
+func seriesID(p *PromMetric) string {
+	pairs := make([]string, 0, len(p.LabelList)/2)
+	for i := 0; i+1 < len(p.LabelList); i += 2 {
+		pairs = append(pairs, strconv.Quote(p.LabelList[i])+"="+strconv.Quote(p.LabelList[i+1]))
+	}
+	slices.Sort(pairs)
+	return p.Name + "{" + strings.Join(pairs, ",") + "}"
+}
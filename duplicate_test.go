@@ -0,0 +1,105 @@
+package prommerge
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	var targets []PromTarget
+	for _, name := range []string{"replica-1", "replica-2"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total{code=\"200\"} 5\n# TYPE queue gauge\nqueue 3\n")
+		}))
+		defer server.Close()
+		// Both replicas are configured with the same extra labels
+		targets = append(targets, PromTarget{Name: name, Url: server.URL, ExtraLabels: []string{`app="api"`}})
+	}
+
+	for policy, expected := range map[DuplicatePolicy]struct {
+		requests []float64
+		queue    []float64
+	}{
+		DuplicatePolicyAllow:     {[]float64{5, 5}, []float64{3, 3}},
+		DuplicatePolicyKeepFirst: {[]float64{5}, []float64{3}},
+		DuplicatePolicySum:       {[]float64{10}, []float64{3}},
+		DuplicatePolicyError:     {[]float64{5}, []float64{3}},
+	} {
+		pd := NewPromData(targets, PromDataOpts{DuplicatePolicy: policy, TargetMetrics: true, SupressErrors: true})
+		err := pd.CollectTargets()
+
+		var duplicateErr *DuplicateSeriesError
+		if policy == DuplicatePolicyError && !errors.As(err, &duplicateErr) {
+			t.Errorf("Receive %v for policy %v; want *DuplicateSeriesError", err, policy)
+		}
+		if policy != DuplicatePolicyError && err != nil {
+			t.Errorf("Receive %v for policy %v; want nil", err, policy)
+		}
+
+		values := make(map[string][]float64)
+		for _, p := range pd.PromMetrics {
+			values[p.Name] = append(values[p.Name], p.Value)
+		}
+		if fmt.Sprint(values["requests_total"]) != fmt.Sprint(expected.requests) || fmt.Sprint(values["queue"]) != fmt.Sprint(expected.queue) {
+			t.Errorf("Receive %v for policy %v; want %+v", values, policy, expected)
+		}
+
+		if policy == DuplicatePolicyAllow {
+			if pd.Duplicates != nil {
+				t.Errorf("Receive duplicates %+v; want none without detection", pd.Duplicates)
+			}
+			continue
+		}
+		// requests_total and queue, the synthetic series of the replicas differ in the instance label
+		if len(pd.Duplicates) != 2 {
+			t.Fatalf("Receive %v duplicates for policy %v; want 2", len(pd.Duplicates), policy)
+		}
+		for _, d := range pd.Duplicates {
+			slices.Sort(d.Targets)
+			if fmt.Sprint(d.Targets) != "[replica-1 replica-2]" {
+				t.Errorf("Receive targets %v for %v; want both replicas", d.Targets, d.Name)
+			}
+		}
+	}
+}
+
+func TestSeriesID(t *testing.T) {
+	a := &PromMetric{Name: "m", LabelList: []string{"app", "api", "code", "200"}}
+	b := &PromMetric{Name: "m", LabelList: []string{"code", "200", "app", "api"}}
+	c := &PromMetric{Name: "m", LabelList: []string{"app", "api,code=200"}}
+	if seriesID(a) != seriesID(b) {
+		t.Errorf("Receive %v and %v; want equal", seriesID(a), seriesID(b))
+	}
+	if seriesID(a) == seriesID(c) {
+		t.Errorf("Receive equal ids for different label sets %v", seriesID(a))
+	}
+}
+
+func TestDuplicatePolicyTargetOrder(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 5\n")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE requests_total counter\nrequests_total 100\n")
+	}))
+	defer fast.Close()
+
+	// The first target responds last, its sample is kept anyway
+	pd := NewPromData([]PromTarget{{Url: slow.URL}, {Url: fast.URL}}, PromDataOpts{Async: true, DuplicatePolicy: DuplicatePolicyKeepFirst, SupressErrors: true})
+	if err := pd.CollectTargets(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if len(pd.PromMetrics) != 1 || pd.PromMetrics[0].Value != 5 {
+		t.Errorf("Receive %v; want the sample of the first target", pd.ToString())
+	}
+	if len(pd.Duplicates) != 1 || fmt.Sprint(pd.Duplicates[0].Targets) != fmt.Sprint([]string{slow.URL, fast.URL}) {
+		t.Errorf("Unexpected duplicates %+v", pd.Duplicates)
+	}
+}
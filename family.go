@@ -0,0 +1,320 @@
+package prommerge
+
+import (
+	"cmp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// MetricType is the type a metric family is declared with
+type MetricType int
+
+const (
+	// MetricTypeUnknown is used for families without a TYPE line
+	MetricTypeUnknown MetricType = iota
+	MetricTypeCounter
+	MetricTypeGauge
+	MetricTypeHistogram
+	MetricTypeSummary
+	MetricTypeUntyped
+	// MetricTypeGaugeHistogram is the OpenMetrics gaugehistogram, the classic text format has no TYPE line for it
+	MetricTypeGaugeHistogram
+)
+
+var metricTypeNames = map[MetricType]string{
+	MetricTypeCounter:        "counter",
+	MetricTypeGauge:          "gauge",
+	MetricTypeHistogram:      "histogram",
+	MetricTypeSummary:        "summary",
+	MetricTypeUntyped:        "untyped",
+	MetricTypeGaugeHistogram: "gaugehistogram",
+}
+
+// String returns the type name used in the TYPE line
+func (t MetricType) String() string {
+	if name, ok := metricTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// classic reports whether families of the type get a TYPE line in the classic text format
+func (t MetricType) classic() bool {
+	return t != MetricTypeUnknown && t != MetricTypeGaugeHistogram
+}
+
+// ParseMetricType parses a type name of the classic text or OpenMetrics format,
+// OpenMetrics info and stateset families are treated as gauges
+func ParseMetricType(s string) (MetricType, bool) {
+	switch s {
+	case "counter":
+		return MetricTypeCounter, true
+	case "gauge", "info", "stateset":
+		return MetricTypeGauge, true
+	case "histogram":
+		return MetricTypeHistogram, true
+	case "gaugehistogram":
+		return MetricTypeGaugeHistogram, true
+	case "summary":
+		return MetricTypeSummary, true
+	case "untyped", "unknown":
+		return MetricTypeUntyped, true
+	}
+	return MetricTypeUnknown, false
+}
+
+// MetricFamily groups the samples of one metric under its metadata. Name is the name of the
+// TYPE line, so histogram and summary families also hold their _bucket, _sum and _count samples.
+type MetricFamily struct {
+	Name string
+	// Help is the unescaped help text
+	Help string
+	Type MetricType
+	// Unit is the OpenMetrics family unit
+	Unit    string
+	Metrics []*PromMetric
+	// targets lists names of the targets the samples come from
+	targets []string
+}
+
+// familySuffixes lists sample name suffixes used by families of the type besides the family name
+var familySuffixes = map[MetricType][]string{
+	MetricTypeHistogram:      {"_bucket", "_count", "_sum"},
+	MetricTypeGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	MetricTypeSummary:        {"_count", "_sum"},
+}
+
+// familyBuilder groups samples of a single exposition into families in order of appearance
+type familyBuilder struct {
+	families []*MetricFamily
+	index    map[string]*MetricFamily
+}
+
+func newFamilyBuilder() *familyBuilder {
+	return &familyBuilder{index: make(map[string]*MetricFamily)}
+}
+
+// family returns the family with the name, creating it on first use
+func (b *familyBuilder) family(name string) *MetricFamily {
+	f := b.index[name]
+	if f == nil {
+		f = &MetricFamily{Name: name}
+		b.index[name] = f
+		b.families = append(b.families, f)
+	}
+	return f
+}
+
+// add puts the sample into the family its name belongs to
+func (b *familyBuilder) add(p *PromMetric) {
+	f := b.family(b.familyName(p.Name))
+	f.Metrics = append(f.Metrics, p)
+}
+
+// familyName resolves a sample name into the name of a declared family by stripping
+// the suffixes the family type allows, undeclared samples make up a family of their own
+func (b *familyBuilder) familyName(name string) string {
+	if _, ok := b.index[name]; ok {
+		return name
+	}
+	for typ, suffixes := range familySuffixes {
+		for _, suffix := range suffixes {
+			if len(name) <= len(suffix) || name[len(name)-len(suffix):] != suffix {
+				continue
+			}
+			base := name[:len(name)-len(suffix)]
+			if f := b.index[base]; f != nil && f.Type == typ {
+				return base
+			}
+		}
+	}
+	return name
+}
+
+// result returns families that got at least one sample
+func (b *familyBuilder) result() []*MetricFamily {
+	families := b.families[:0]
+	for _, f := range b.families {
+		if len(f.Metrics) > 0 {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// countSamples returns the number of samples in the families
+func countSamples(families []*MetricFamily) int {
+	n := 0
+	for _, f := range families {
+		n += len(f.Metrics)
+	}
+	return n
+}
+
+// mergeFamilies adds families of a target to the merged result, samples of families with the same name
+// and compatible metadata are appended to the first one. Families with conflicting HELP or TYPE are kept
+// apart until resolveConflicts is called.
+func (pd *PromData) mergeFamilies(families []*MetricFamily) {
+	if pd.familyIndex == nil {
+		pd.familyIndex = make(map[string][]*MetricFamily)
+	}
+	for _, f := range families {
+		var merged *MetricFamily
+		for _, variant := range pd.familyIndex[f.Name] {
+			if compatibleMetadata(variant, f) {
+				merged = variant
+				break
+			}
+		}
+		if merged == nil {
+			pd.familyIndex[f.Name] = append(pd.familyIndex[f.Name], f)
+			pd.MetricFamilies = append(pd.MetricFamilies, f)
+			continue
+		}
+		merged.Metrics = append(merged.Metrics, f.Metrics...)
+		merged.targets = append(merged.targets, f.targets...)
+		if merged.Help == "" {
+			merged.Help = f.Help
+		}
+		if merged.Type == MetricTypeUnknown {
+			merged.Type = f.Type
+		}
+		if merged.Unit == "" {
+			merged.Unit = f.Unit
+		}
+	}
+}
+
+// cloneFamilies copies families and their samples, so merging the copies leaves the originals intact
+func cloneFamilies(families []*MetricFamily) []*MetricFamily {
+	clones := make([]*MetricFamily, len(families))
+	for i, f := range families {
+		clone := *f
+		clone.targets = slices.Clone(f.targets)
+		clone.Metrics = make([]*PromMetric, len(f.Metrics))
+		for j, p := range f.Metrics {
+			sample := *p
+			clone.Metrics[j] = &sample
+		}
+		clones[i] = &clone
+	}
+	return clones
+}
+
+// compatibleMetadata reports whether two families with the same name may be merged,
+// missing HELP or TYPE does not conflict with any
+func compatibleMetadata(a, b *MetricFamily) bool {
+	if a.Help != "" && b.Help != "" && a.Help != b.Help {
+		return false
+	}
+	return a.Type == MetricTypeUnknown || b.Type == MetricTypeUnknown || a.Type == b.Type
+}
+
+// resetFamilies drops the merged result
+func (pd *PromData) resetFamilies() {
+	pd.MetricFamilies = nil
+	pd.familyIndex = nil
+	pd.PromMetrics = nil
+	pd.Conflicts = nil
+	pd.Duplicates = nil
+}
+
+// finishMerge resolves metadata conflicts and duplicate series of the merged families and lists the samples
+// in PromMetrics. The merged result stays usable if *ConflictError or *DuplicateSeriesError is returned.
+func (pd *PromData) finishMerge() error {
+	conflictErr := pd.resolveConflicts()
+	duplicateErr := pd.dedupSeries()
+	pd.flattenFamilies()
+	if conflictErr != nil {
+		return conflictErr
+	}
+	return duplicateErr
+}
+
+// flattenFamilies lists samples of all families in PromMetrics in family order
+func (pd *PromData) flattenFamilies() {
+	pd.PromMetrics = make([]*PromMetric, 0, countSamples(pd.MetricFamilies))
+	for _, f := range pd.MetricFamilies {
+		pd.PromMetrics = append(pd.PromMetrics, f.Metrics...)
+	}
+}
+
+// sortFamilies orders families by name and samples of each family by series, suffix and bucket bound,
+// so the _bucket, _sum and _count samples of a series stay together and buckets are in le order
+func (pd *PromData) sortFamilies() {
+	sort.Slice(pd.MetricFamilies, func(i, j int) bool {
+		return pd.MetricFamilies[i].Name < pd.MetricFamilies[j].Name
+	})
+	for _, f := range pd.MetricFamilies {
+		keys := make(map[*PromMetric]sampleKey, len(f.Metrics))
+		for _, p := range f.Metrics {
+			keys[p] = newSampleKey(f, p)
+		}
+		slices.SortStableFunc(f.Metrics, func(a, b *PromMetric) int {
+			return keys[a].compare(keys[b])
+		})
+	}
+	pd.flattenFamilies()
+}
+
+// sampleKey is the sort key of a sample within its family
+type sampleKey struct {
+	// series is the label list without the le label of buckets and the quantile label of summaries
+	series []string
+	// rank orders the suffixes of a series, bucket and quantile samples come before _sum, _count and _created
+	rank   int
+	suffix string
+	// bound is the value of the le or quantile label
+	bound float64
+}
+
+var suffixRanks = map[string]int{
+	"":         0,
+	"_total":   0,
+	"_info":    0,
+	"_bucket":  0,
+	"_sum":     1,
+	"_gsum":    1,
+	"_count":   2,
+	"_gcount":  2,
+	"_created": 3,
+}
+
+func newSampleKey(f *MetricFamily, p *PromMetric) sampleKey {
+	key := sampleKey{suffix: strings.TrimPrefix(p.Name, f.Name)}
+	rank, ok := suffixRanks[key.suffix]
+	if !ok {
+		rank = len(suffixRanks)
+	}
+	key.rank = rank
+	boundLabel := ""
+	switch {
+	case key.suffix == "_bucket":
+		boundLabel = "le"
+	case key.suffix == "" && f.Type == MetricTypeSummary:
+		boundLabel = "quantile"
+	}
+	key.series = p.LabelList
+	for i := 0; i+1 < len(p.LabelList) && boundLabel != ""; i += 2 {
+		if p.LabelList[i] == boundLabel {
+			key.series = slices.Delete(slices.Clone(p.LabelList), i, i+2)
+			key.bound, _ = ParseValue(p.LabelList[i+1])
+			break
+		}
+	}
+	return key
+}
+
+func (k sampleKey) compare(o sampleKey) int {
+	if c := slices.Compare(k.series, o.series); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(k.rank, o.rank); c != 0 {
+		return c
+	}
+	if c := strings.Compare(k.suffix, o.suffix); c != 0 {
+		return c
+	}
+	return cmp.Compare(k.bound, o.bound)
+}
@@ -0,0 +1,105 @@
+package prommerge
+
+import (
+	"fmt"
+)
+
+// MetricFilter selects metric families by name with anchored regexps. A family passes if it matches
+// any Include pattern, or Include is empty, and matches no Exclude pattern. Samples of histograms and
+// summaries follow their family, so `http_duration_seconds` keeps its _bucket, _sum and _count series.
+type MetricFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (mf MetricFilter) empty() bool {
+	return len(mf.Include) == 0 && len(mf.Exclude) == 0
+}
+
+// Validate checks the patterns compile
+func (mf MetricFilter) Validate() error {
+	for _, expr := range append(mf.Include[:len(mf.Include):len(mf.Include)], mf.Exclude...) {
+		if _, err := anchoredRegexp(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mf MetricFilter) allows(name string) bool {
+	match := func(patterns []string) bool {
+		for _, expr := range patterns {
+			re, err := anchoredRegexp(expr)
+			if err == nil && re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(mf.Include) == 0 || match(mf.Include)) && !match(mf.Exclude)
+}
+
+// nameFilter applies the global and target filters while a target is parsed, decisions are cached
+// per family name so that every later sample of a family costs a map lookup
+type nameFilter struct {
+	filters   []MetricFilter
+	decisions map[string]bool
+}
+
+// newNameFilter returns nil if neither the global nor the target filter is set
+func (pd *PromData) newNameFilter(target MetricFilter) *nameFilter {
+	var filters []MetricFilter
+	for _, mf := range []MetricFilter{pd.MetricFilter, target} {
+		if !mf.empty() {
+			filters = append(filters, mf)
+		}
+	}
+	if filters == nil {
+		return nil
+	}
+	return &nameFilter{filters: filters, decisions: make(map[string]bool)}
+}
+
+// allows reports whether samples of the family are kept, a nil filter keeps everything
+func (f *nameFilter) allows(family string) bool {
+	if f == nil {
+		return true
+	}
+	allowed, ok := f.decisions[family]
+	if !ok {
+		allowed = true
+		for _, mf := range f.filters {
+			allowed = allowed && mf.allows(family)
+		}
+		f.decisions[family] = allowed
+	}
+	return allowed
+}
+
+// sampleName returns the metric name at the beginning of a sample line, as metricRe does but without
+// the regexp, so filtered lines are skipped cheaply
+func sampleName(line string) string {
+	i := 0
+	for i < len(line) && (line[i] == ':' || isLabelNameChar(line[i], i == 0)) {
+		i++
+	}
+	return line[:i]
+}
+
+// validateTargets checks relabel configs and metric filters of all targets before anything is fetched
+func (pd *PromData) validateTargets() error {
+	if err := pd.MetricFilter.Validate(); err != nil {
+		return fmt.Errorf("metric filter: %v", err)
+	}
+	for _, target := range pd.PromTargets {
+		for i, rc := range pd.relabelConfigs(target) {
+			if err := rc.Validate(); err != nil {
+				return fmt.Errorf("relabel config %v of target %v: %v", i, target.Url, err)
+			}
+		}
+		if err := target.MetricFilter.Validate(); err != nil {
+			return fmt.Errorf("metric filter of target %v: %v", target.Url, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package prommerge
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricFilter(t *testing.T) {
+	mf := MetricFilter{Include: []string{"node_.*", "up"}, Exclude: []string{"node_cpu_.*"}}
+	for name, expected := range map[string]bool{
+		"node_load1":              true,
+		"up":                      true,
+		"node_cpu_seconds_total":  false,
+		"go_goroutines":           false,
+		"xnode_load1":             false,
+		"node_load1_extra_suffix": true,
+	} {
+		if allowed := mf.allows(name); allowed != expected {
+			t.Errorf("Receive %v for %v; want %v", allowed, name, expected)
+		}
+	}
+	if err := (MetricFilter{Exclude: []string{"("}}).Validate(); err == nil {
+		t.Errorf("Receive nil error for an invalid pattern")
+	}
+}
+
+func TestParseMetricDataFilter(t *testing.T) {
+	input := strings.Join([]string{
+		"# TYPE rpc_seconds histogram",
+		`rpc_seconds_bucket{le="+Inf"} 3`,
+		"rpc_seconds_sum 1.5",
+		"rpc_seconds_count 3",
+		"# TYPE node_cpu_seconds_total counter",
+		`node_cpu_seconds_total{cpu="0" 1`,
+		`node_cpu_seconds_total{cpu="1"} oops`,
+		"jobs 1",
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{})
+	filter := pd.newNameFilter(MetricFilter{Include: []string{"rpc_seconds", "node_.*"}, Exclude: []string{"node_cpu_.*"}})
+	families, badLines, err := pd.parseMetricData(input, nil, filter)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	// Lines of the excluded family are not parsed at all, so they are not reported as bad
+	if badLines != 0 {
+		t.Errorf("Receive %v bad lines; want 0", badLines)
+	}
+	if len(families) != 1 || families[0].Name != "rpc_seconds" || len(families[0].Metrics) != 3 {
+		t.Errorf("Unexpected families %+v", families)
+	}
+}
+
+func TestCollectFilteredTargets(t *testing.T) {
+	target := httptest.NewServer(promhttp.Handler())
+	defer target.Close()
+
+	for _, preferProtobuf := range []bool{false, true} {
+		pd := NewPromData([]PromTarget{
+			{Url: target.URL, ExtraLabels: []string{`app="a"`}, MetricFilter: MetricFilter{Include: []string{"go_.*"}}},
+			{Url: target.URL, ExtraLabels: []string{`app="b"`}, MetricFilter: MetricFilter{Include: []string{"go_gc_duration_seconds"}}},
+		}, PromDataOpts{PreferProtobuf: preferProtobuf, MetricFilter: MetricFilter{Exclude: []string{"go_memstats_.*"}}})
+		if err := pd.CollectTargets(); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		apps := make(map[string]int)
+		for _, p := range pd.PromMetrics {
+			if !strings.HasPrefix(p.Name, "go_") || strings.HasPrefix(p.Name, "go_memstats_") {
+				t.Errorf("Receive filtered metric %v", p.Name)
+			}
+			app := FormatLabels(p.LabelList[:2])
+			if app == `{app="b"}` && !strings.HasPrefix(p.Name, "go_gc_duration_seconds") {
+				t.Errorf("Receive %v for target b; want only go_gc_duration_seconds", p.Name)
+			}
+			apps[app]++
+		}
+		if apps[`{app="a"}`] <= apps[`{app="b"}`] || apps[`{app="b"}`] == 0 {
+			t.Errorf("Unexpected samples per target %v with protobuf %v", fmt.Sprint(apps), preferProtobuf)
+		}
+	}
+}
+
+func TestOmitMetaFilter(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# HELP rpc_seconds RPC latency.")
+		fmt.Fprintln(w, "# TYPE rpc_seconds histogram")
+		fmt.Fprintln(w, `rpc_seconds_bucket{le="+Inf"} 3`)
+		fmt.Fprintln(w, "rpc_seconds_sum 1.5")
+		fmt.Fprintln(w, "rpc_seconds_count 3")
+		fmt.Fprintln(w, "jobs 1")
+	}))
+	defer target.Close()
+
+	pd := NewPromData([]PromTarget{{Url: target.URL, MetricFilter: MetricFilter{Include: []string{"rpc_seconds"}}}}, PromDataOpts{OmitMeta: true})
+	if err := pd.CollectTargets(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	expected := `rpc_seconds_bucket{le="+Inf"} 3
+rpc_seconds_sum 1.5
+rpc_seconds_count 3
+`
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+	if len(pd.MetricFamilies) != 1 || pd.MetricFamilies[0].Type != MetricTypeHistogram {
+		t.Errorf("Unexpected families %+v", pd.MetricFamilies)
+	}
+}
@@ -1,30 +1,51 @@
 package prommerge
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"log/slog"
+	"net/http"
 	"sync"
 	"time"
 )
 
 func (pd *PromData) AsyncHTTP() error {
+	return pd.AsyncHTTPContext(context.Background())
+}
+
+// AsyncHTTPContext fetches and merges all targets, aborting outstanding requests once ctx is done.
+// On cancellation MetricFamilies keeps the metrics merged so far and the context error is returned.
+// Targets are merged in PromTargets order once all of them are parsed, then metadata conflicts and
+// duplicate series are handled, see finishMerge.
+func (pd *PromData) AsyncHTTPContext(ctx context.Context) (err error) {
 	t := time.Now()
 	defer func() {
 		pd.CollectTargetsDuration = time.Since(t)
 		slog.Debug("Targets are collected", slog.String("duration", pd.CollectTargetsDuration.String()), slog.Int("len", len(pd.PromMetrics)))
 	}()
+	if err := pd.validateTargets(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	httpWg, parserWg, bodyData, workerPool :=
 		new(sync.WaitGroup),
 		new(sync.WaitGroup),
 		make(chan *PromChanData),
 		make(chan struct{}, pd.workerPoolSize)
 
-	pd.PromMetrics = nil
+	// The stream is closed at the end of every collection, so each one gets its own
+	pd.PromMetricsStream = make(chan []*MetricFamily, 20)
+	pd.MergeWorkerDoneHook = make(chan struct{})
+	pd.resetFamilies()
+	pd.TargetResults = make([]TargetResult, len(pd.PromTargets))
+	pd.scraped = make([][]*MetricFamily, len(pd.PromTargets))
+	discard := false
 
 	for i, _ := range pd.PromTargets {
 		httpWg.Add(1)
-		go pd.AHTTP(httpWg, bodyData, workerPool, pd.PromTargets[i])
+		pd.TargetResults[i] = TargetResult{Name: pd.PromTargets[i].Name, Url: pd.PromTargets[i].Url, index: i}
+		go pd.AHTTP(ctx, httpWg, bodyData, workerPool, pd.PromTargets[i], &pd.TargetResults[i])
 	}
 
 	go func() {
@@ -36,8 +57,26 @@ func (pd *PromData) AsyncHTTP() error {
 	}()
 
 	defer func() {
+		// Stop pending requests and parsers before the stream is closed
+		cancel()
+		httpWg.Wait()
+		parserWg.Wait()
+		// Targets are merged in PromTargets order rather than as they respond, so the policies
+		// picking the first target's family or sample do not depend on response times
+		for _, families := range pd.scraped {
+			if families != nil && !discard {
+				pd.PromMetricsStream <- families
+			}
+		}
+		pd.scraped = nil
 		close(pd.PromMetricsStream)
 		<-pd.MergeWorkerDoneHook
+		if discard {
+			pd.resetFamilies()
+		}
+		if mergeErr := pd.finishMerge(); mergeErr != nil && err == nil {
+			err = mergeErr
+		}
 		slog.Debug("Release lock")
 	}()
 
@@ -45,12 +84,24 @@ func (pd *PromData) AsyncHTTP() error {
 
 	for {
 		select {
+		case <-ctx.Done():
+			slog.Debug("Collecting is canceled", slog.String("err", ctx.Err().Error()))
+			return fmt.Errorf("collecting targets is canceled, %w", ctx.Err())
 		case promData, ok := <-bodyData:
 			if !ok {
 				slog.Debug("bodyData is closed", slog.Int("len(bodyData)", len(bodyData)), slog.Int("len(PromMetricsStream)", len(pd.PromMetricsStream)))
 				tM := time.Now()
 				parserWg.Wait()
 				slog.Debug("Merge routine completed", slog.String("duration", time.Since(tM).String()))
+				if pd.EmptyOnFailure {
+					// A target rejected by StrictParsing fails the collection like an unreachable one
+					for _, res := range pd.TargetResults {
+						if res.Err != nil && res.ParseErrors > 0 {
+							discard = true
+							return fmt.Errorf("failed to parse target %v, %w", res.target(), res.Err)
+						}
+					}
+				}
 				return nil
 			}
 			if promData == nil {
@@ -61,8 +112,8 @@ func (pd *PromData) AsyncHTTP() error {
 			}
 			if promData.Err != nil && pd.EmptyOnFailure {
 				slog.Debug("Return empty result")
-				pd.PromMetrics = nil
-				return fmt.Errorf("failed make async http request, %v", promData.Err)
+				discard = true
+				return fmt.Errorf("failed make async http request, %w", promData.Err)
 			}
 			if promData.Err != nil && !pd.EmptyOnFailure {
 				if !pd.SupressErrors {
@@ -74,72 +125,216 @@ func (pd *PromData) AsyncHTTP() error {
 
 			// Send metric to merge worker
 			parserWg.Add(1)
-			go pd.RouteMetric(parserWg, promData)
+			go pd.RouteMetric(ctx, parserWg, promData)
 		}
 	}
 }
 
-func (pd *PromData) RouteMetric(wg *sync.WaitGroup, promData *PromChanData) {
+// RouteMetric parses the target body and keeps the families until every target is done, AsyncHTTPContext
+// then passes them to the merge worker in target order
+func (pd *PromData) RouteMetric(ctx context.Context, wg *sync.WaitGroup, promData *PromChanData) {
 	defer func() {
 		wg.Done()
 	}()
-	metrics := pd.ParseMetricData(promData.Data, promData.ExtraLabels)
-	if metrics != nil {
-		pd.PromMetricsStream <- metrics
+	families := pd.processTarget(promData)
+	if len(families) == 0 {
+		return
+	}
+	if ctx.Err() != nil {
+		slog.Debug("Drop parsed metrics, collecting is canceled")
+		return
 	}
+	pd.scraped[promData.Result.index] = families
+}
+
+// processTarget parses a fetched target body and rewrites its samples, the families are ready to be merged
+func (pd *PromData) processTarget(promData *PromChanData) []*MetricFamily {
+	filter := pd.newNameFilter(promData.MetricFilter)
+	families, badLines, err := pd.parseTargetData(promData.Data, promData.ContentType, promData.ExtraLabels, filter)
+	if promData.Result != nil {
+		promData.Result.Samples = countSamples(families)
+		promData.Result.ParseErrors = badLines
+		if err != nil {
+			promData.Result.ParseErrors++
+			promData.Result.Err = err
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to parse target", slog.String("url", promData.Source), slog.String("err", err.Error()))
+		return nil
+	}
+	if badLines > 0 && !pd.SupressErrors {
+		slog.Warn("Skipped bad lines", slog.String("url", promData.Source), slog.Int("count", badLines))
+	}
+	if extra := len(ExtraLabelList(promData.ExtraLabels)); extra > 0 {
+		for _, f := range families {
+			for _, p := range f.Metrics {
+				p.LabelList = resolveLabelCollisions(p.LabelList, extra, promData.HonorLabels)
+			}
+		}
+	}
+	families = pd.relabelFamilies(families, promData.RelabelConfigs)
+	target := promData.Source
+	if promData.Result != nil {
+		target = promData.Result.target()
+	}
+	for _, f := range families {
+		f.targets = []string{target}
+		for _, p := range f.Metrics {
+			p.target = target
+		}
+	}
+	return families
 }
 
 func (pd *PromData) MetricsMergeWorker() {
 	for {
 		select {
-		case metrics, ok := <-pd.PromMetricsStream:
+		case families, ok := <-pd.PromMetricsStream:
 			if !ok {
 				slog.Debug("Metrics stream is closed, all messages should be processed", slog.Int("len(PromMetricsStream)", len(pd.PromMetricsStream)))
 				pd.MergeWorkerDoneHook <- struct{}{}
 				return
 			}
-			pd.PromMetrics = append(pd.PromMetrics, metrics...)
+			pd.mergeFamilies(families)
 		}
 	}
 }
 
-func (pd *PromData) AHTTP(wg *sync.WaitGroup, bodyData chan *PromChanData, workerPool chan struct{}, target PromTarget) {
+// AHTTP fetches a single target and sends its body to bodyData, the outcome is recorded into result
+func (pd *PromData) AHTTP(ctx context.Context, wg *sync.WaitGroup, bodyData chan *PromChanData, workerPool chan struct{}, target PromTarget, result *TargetResult) {
 	defer wg.Done()
+
+	slog.Debug("Acquire worker")
+	select {
+	case workerPool <- struct{}{}:
+	case <-ctx.Done():
+		result.Err = ctx.Err()
+		return
+	}
 	defer func() {
 		slog.Debug("Release worker")
 		<-workerPool
 	}()
 
+	send := func(data *PromChanData) {
+		select {
+		case bodyData <- data:
+		case <-ctx.Done():
+		}
+	}
+
+	promData := pd.scrape(ctx, target, result)
+	if promData.Err == nil {
+		slog.Debug("Async http executed", slog.String("duration", result.Duration.String()))
+	}
+	send(promData)
+}
+
+// scrapeTarget fetches and processes a single target outside of a collection, the families are not merged
+func (pd *PromData) scrapeTarget(ctx context.Context, target PromTarget) ([]*MetricFamily, TargetResult) {
+	result := TargetResult{Name: target.Name, Url: target.Url}
+	promData := pd.scrape(ctx, target, &result)
+	if promData.Err != nil {
+		return nil, result
+	}
+	// processTarget records parse outcomes into result, so it has to run before result is returned
+	families := pd.processTarget(promData)
+	return families, result
+}
+
+// scrape fetches the target body, the request outcome is recorded into result
+func (pd *PromData) scrape(ctx context.Context, target PromTarget, result *TargetResult) *PromChanData {
 	t := time.Now()
-	slog.Debug("Acquire worker")
-	workerPool <- struct{}{}
+	body := pd.bodyBuffers.get(target.Url)
+	defer pd.bodyBuffers.put(target.Url, body)
+	contentType, statusCode, err := pd.fetchTarget(ctx, target, body)
+	result.StatusCode = statusCode
+	result.BytesRead = body.Len()
+	result.Duration = time.Since(t)
+	result.Err = err
+	if err != nil {
+		return &PromChanData{Err: err, Result: result}
+	}
+	return &PromChanData{
+		// The buffer goes back to the pool, samples are parsed from a copy
+		Data:           body.String(),
+		Source:         target.Url,
+		ContentType:    contentType,
+		ExtraLabels:    target.ExtraLabels,
+		RelabelConfigs: pd.relabelConfigs(target),
+		MetricFilter:   target.MetricFilter,
+		HonorLabels:    target.HonorLabels,
+		Result:         result,
+	}
+}
+
+// fetchTarget reads the target body into body, retrying failed attempts according to the target ScrapePolicy
+func (pd *PromData) fetchTarget(ctx context.Context, target PromTarget, body *bytes.Buffer) (string, int, error) {
+	policy := target.ScrapePolicy
+	for attempt := 0; ; attempt++ {
+		body.Reset()
+		contentType, statusCode, err := pd.fetchTargetOnce(ctx, target, body)
+		if err == nil {
+			return contentType, statusCode, nil
+		}
+		body.Reset()
+		if attempt >= policy.MaxRetries || ctx.Err() != nil || !policy.retryable(statusCode, err) {
+			return "", statusCode, err
+		}
+		backoff := policy.backoff(attempt)
+		slog.Debug("Retry target", slog.String("url", target.Url), slog.Int("attempt", attempt+1), slog.String("backoff", backoff.String()), slog.String("err", err.Error()))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", statusCode, err
+		}
+	}
+}
+
+// acceptHeader lists the formats targets are asked for, the classic text format unless another one is preferred
+func (pd *PromData) acceptHeader() string {
+	switch {
+	case pd.PreferProtobuf && pd.PreferOpenMetrics:
+		return protobufAccept + "," + OpenMetricsAcceptHeader
+	case pd.PreferProtobuf:
+		return ProtobufAcceptHeader
+	case pd.PreferOpenMetrics:
+		return OpenMetricsAcceptHeader
+	}
+	return AcceptHeader
+}
+
+// fetchTargetOnce makes a single request and reads the response into body, statusCode is zero
+// if the target did not respond
+func (pd *PromData) fetchTargetOnce(ctx context.Context, target PromTarget, body *bytes.Buffer) (contentType string, statusCode int, err error) {
+	if target.ScrapePolicy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.ScrapePolicy.Timeout)
+		defer cancel()
+	}
 
 	slog.Debug("Get endpoint", slog.String("url", target.Url))
-	response, err := pd.httpClient.Get(target.Url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.Url, nil)
 	if err != nil {
-		bodyData <- &PromChanData{Err: fmt.Errorf("http get error for %s: %v", target.Url, err)}
-		return
+		return "", 0, fmt.Errorf("http request error for %s: %w", target.Url, err)
 	}
-	if response.StatusCode > 299 {
-		bodyData <- &PromChanData{Err: fmt.Errorf("http get failed for %s, response code expected 200, actual %v", target.Url, response.StatusCode)}
-		return
+	request.Header.Set("Accept", pd.acceptHeader())
+	response, err := pd.httpClient.Do(request)
+	if err != nil {
+		return "", 0, fmt.Errorf("http get error for %s: %w", target.Url, err)
 	}
 	defer func() {
-		err = response.Body.Close()
+		err := response.Body.Close()
 		if err != nil {
 			slog.Error("Failed to close http request body", slog.String("err", err.Error()))
 		}
 	}()
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		bodyData <- &PromChanData{Err: fmt.Errorf("error reading data from %s: %v", target.Url, err)}
-		return
+	if response.StatusCode > 299 {
+		return "", response.StatusCode, fmt.Errorf("http get failed for %s, response code expected 200, actual %v", target.Url, response.StatusCode)
 	}
-	bodyData <- &PromChanData{
-		Data:        string(body),
-		ExtraLabels: target.ExtraLabels,
+	if _, err := body.ReadFrom(response.Body); err != nil {
+		return "", response.StatusCode, fmt.Errorf("error reading data from %s: %w", target.Url, err)
 	}
-
-	slog.Debug("Async http executed", slog.String("duration", time.Since(t).String()))
-	return
+	return response.Header.Get("Content-Type"), response.StatusCode, nil
 }
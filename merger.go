@@ -0,0 +1,286 @@
+package prommerge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrNotScraped is reported by Merger.Snapshot for targets without a finished background scrape
+var ErrNotScraped = errors.New("target is not scraped yet")
+
+// Merger is a long-lived collector of a target set. It is safe for concurrent use, every collection
+// works on a new PromData, so handlers may collect at the same time while targets and options are
+// replaced with Update. Between collections the Merger keeps the target set, the results of the
+// last collection, the background scrape state and the response body buffers of each target,
+// merged results are not reused.
+//
+// Besides collecting on demand, Run scrapes the targets in the background and Snapshot serves the
+// latest scraped metrics without waiting for any target.
+type Merger struct {
+	mu        sync.RWMutex
+	targets   []PromTarget
+	opts      PromDataOpts
+	results   []TargetResult
+	snapshots map[string]*targetSnapshot
+	bodies    *bodyBufferPool
+	// updated wakes Run up to scrape new targets without waiting for the next round
+	updated chan struct{}
+}
+
+// maxBodyBuffers bounds the idle body buffers kept for a single target URL
+const maxBodyBuffers = 2
+
+// bodyBufferPool keeps response body buffers by target URL between scrapes. A buffer returns to
+// the target it was grown for, so bodies of the same size are read again without reallocation.
+type bodyBufferPool struct {
+	mu      sync.Mutex
+	buffers map[string][]*bytes.Buffer
+}
+
+func newBodyBufferPool() *bodyBufferPool {
+	return &bodyBufferPool{buffers: make(map[string][]*bytes.Buffer)}
+}
+
+// get returns an idle buffer of the URL or a new one, a nil pool always returns a new one
+func (bp *bodyBufferPool) get(url string) *bytes.Buffer {
+	if bp == nil {
+		return new(bytes.Buffer)
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	idle := bp.buffers[url]
+	if len(idle) == 0 {
+		return new(bytes.Buffer)
+	}
+	buf := idle[len(idle)-1]
+	bp.buffers[url] = idle[:len(idle)-1]
+	return buf
+}
+
+// put hands the buffer back once its content is no longer referenced
+func (bp *bodyBufferPool) put(url string, buf *bytes.Buffer) {
+	if bp == nil {
+		return
+	}
+	buf.Reset()
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if idle := bp.buffers[url]; len(idle) < maxBodyBuffers {
+		bp.buffers[url] = append(idle, buf)
+	}
+}
+
+// retain drops buffers of URLs no longer scraped
+func (bp *bodyBufferPool) retain(targets []PromTarget) {
+	urls := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		urls[target.Url] = true
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for url := range bp.buffers {
+		if !urls[url] {
+			delete(bp.buffers, url)
+		}
+	}
+}
+
+// targetSnapshot is the background scrape state of a single target
+type targetSnapshot struct {
+	// families of the last successful scrape, they are replaced as a whole and never modified
+	families []*MetricFamily
+	scraped  time.Time
+	// result of the last finished scrape, successful or not
+	result   TargetResult
+	finished bool
+	running  bool
+}
+
+func NewMerger(targets []PromTarget, opts PromDataOpts) *Merger {
+	return &Merger{targets: slices.Clone(targets), opts: opts, bodies: newBodyBufferPool(), updated: make(chan struct{}, 1)}
+}
+
+// Update replaces targets and options for the next collections, running ones finish with the previous set.
+// Run starts a scrape round right away, so new targets do not wait for the next interval.
+func (m *Merger) Update(targets []PromTarget, opts PromDataOpts) {
+	m.mu.Lock()
+	m.targets = slices.Clone(targets)
+	m.opts = opts
+	m.mu.Unlock()
+	m.bodies.retain(targets)
+	select {
+	case m.updated <- struct{}{}:
+	default:
+	}
+}
+
+// Targets returns a copy of the current target set
+func (m *Merger) Targets() []PromTarget {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.targets)
+}
+
+// Options returns the current options
+func (m *Merger) Options() PromDataOpts {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.opts
+}
+
+// TargetResults returns the target results of the last finished collection
+func (m *Merger) TargetResults() []TargetResult {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.results)
+}
+
+// Collect fetches and merges the current targets into a new PromData, see PromData.CollectTargetsContext
+func (m *Merger) Collect(ctx context.Context) (*PromData, error) {
+	m.mu.RLock()
+	pd := NewPromData(m.targets, m.opts)
+	m.mu.RUnlock()
+	pd.bodyBuffers = m.bodies
+
+	err := pd.CollectTargetsContext(ctx)
+	m.mu.Lock()
+	m.results = pd.TargetResults
+	m.mu.Unlock()
+	return pd, err
+}
+
+// Run scrapes the targets every ScrapeInterval until ctx is done, the scraped metrics are served by
+// Snapshot. Every target is scraped on its own, one that is still being scraped when the next round
+// starts is skipped in that round, so a slow target delays only its own metrics.
+func (m *Merger) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		timer := time.NewTimer(m.scrapeRound(ctx, &wg))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-m.updated:
+			timer.Stop()
+		}
+	}
+}
+
+// scrapeRound starts scrapes of the current targets that are not running yet and returns the pause
+// before the next round
+func (m *Merger) scrapeRound(ctx context.Context, wg *sync.WaitGroup) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	interval := m.opts.ScrapeInterval
+	if interval <= 0 {
+		interval = DefaultScrapeInterval
+	}
+	pd := NewPromData(m.targets, m.opts)
+	pd.bodyBuffers = m.bodies
+	if err := pd.validateTargets(); err != nil {
+		slog.Error("Skip background scrape", slog.String("err", err.Error()))
+		return interval
+	}
+
+	// State of removed targets is dropped, scrapes still running for them finish unnoticed
+	snapshots := make(map[string]*targetSnapshot, len(m.targets))
+	for i, key := range targetKeys(m.targets) {
+		s, ok := m.snapshots[key]
+		if !ok {
+			s = &targetSnapshot{}
+		}
+		snapshots[key] = s
+		if s.running {
+			continue
+		}
+		s.running = true
+		wg.Add(1)
+		go func(target PromTarget) {
+			defer wg.Done()
+			families, result := pd.scrapeTarget(ctx, target)
+			if result.Err != nil && !pd.SupressErrors && ctx.Err() == nil {
+				slog.Error("Failed to scrape target", slog.String("target", result.target()), slog.String("err", result.Err.Error()))
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			s.running = false
+			if ctx.Err() != nil && result.Err != nil {
+				// Canceled by the caller of Run, the previous scrape stays in place
+				return
+			}
+			s.result, s.finished = result, true
+			if result.Err == nil {
+				s.families, s.scraped = families, time.Now()
+			}
+		}(m.targets[i])
+	}
+	m.snapshots = snapshots
+	return interval
+}
+
+// Snapshot merges the latest background scrape of every target into a new PromData without fetching
+// anything. Series of targets whose last successful scrape is older than StalenessLimit are dropped.
+// TargetResults describe the last scrape of every target, ErrNotScraped is set for targets not scraped
+// yet and an error describing the staleness for dropped ones.
+func (m *Merger) Snapshot() (*PromData, error) {
+	t := time.Now()
+	m.mu.RLock()
+	pd := NewPromData(slices.Clone(m.targets), m.opts)
+	pd.TargetResults = make([]TargetResult, len(pd.PromTargets))
+	var scraped [][]*MetricFamily
+	for i, key := range targetKeys(pd.PromTargets) {
+		res := &pd.TargetResults[i]
+		s, ok := m.snapshots[key]
+		if !ok || !s.finished {
+			*res = TargetResult{Name: pd.PromTargets[i].Name, Url: pd.PromTargets[i].Url, Err: ErrNotScraped}
+			continue
+		}
+		*res = s.result
+		if s.scraped.IsZero() {
+			continue
+		}
+		if age := t.Sub(s.scraped); m.opts.StalenessLimit > 0 && age > m.opts.StalenessLimit {
+			if res.Err == nil {
+				res.Err = fmt.Errorf("metrics of %v are stale, last scraped %v ago", res.target(), age.Round(time.Millisecond))
+			}
+			continue
+		}
+		scraped = append(scraped, s.families)
+	}
+	m.mu.RUnlock()
+
+	if pd.EmptyOnFailure {
+		for _, res := range pd.TargetResults {
+			if res.Err != nil {
+				return pd, fmt.Errorf("target %v has no fresh metrics, %w", res.target(), res.Err)
+			}
+		}
+	}
+	for _, families := range scraped {
+		pd.mergeFamilies(cloneFamilies(families))
+	}
+	err := pd.finishMerge()
+	pd.CollectTargetsDuration = time.Since(t)
+	return pd, pd.completeCollect(context.Background(), err)
+}
+
+// targetKeys identifies background scrape state of targets across updates, identical targets are told
+// apart by their order
+func targetKeys(targets []PromTarget) []string {
+	keys := make([]string, len(targets))
+	seen := make(map[string]int, len(targets))
+	for i, target := range targets {
+		key := fmt.Sprintf("%v\xff%v\xff%v", target.Name, target.Url, target.ExtraLabels)
+		keys[i] = fmt.Sprintf("%v\xff%v", key, seen[key])
+		seen[key]++
+	}
+	return keys
+}
@@ -0,0 +1,183 @@
+package prommerge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMergerConcurrentCollect(t *testing.T) {
+	var servers []*httptest.Server
+	for _, app := range []string{"api", "web"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "# TYPE requests_total counter\nrequests_total{handler=%q} 1\n", app)
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+
+	m := NewMerger([]PromTarget{{Url: servers[0].URL}}, PromDataOpts{Sort: true})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pd, err := m.Collect(context.Background())
+			if err != nil {
+				t.Errorf("Receive %v; want nil", err)
+				return
+			}
+			var buffer strings.Builder
+			if _, err := pd.WriteTo(&buffer); err != nil {
+				t.Errorf("Receive %v; want nil", err)
+			}
+			if !strings.Contains(buffer.String(), `requests_total{handler="api"} 1`) {
+				t.Errorf("Receive %v; want the api target", buffer.String())
+			}
+		}()
+		if i == 10 {
+			m.Update([]PromTarget{{Url: servers[0].URL}, {Url: servers[1].URL}}, PromDataOpts{Sort: true})
+		}
+	}
+	wg.Wait()
+
+	pd, err := m.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	expected := "# TYPE requests_total counter\n" +
+		`requests_total{handler="api"} 1` + "\n" +
+		`requests_total{handler="web"} 1` + "\n"
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+	if results := m.TargetResults(); len(results) != 2 || results[1].Err != nil {
+		t.Errorf("Unexpected target results %+v", results)
+	}
+}
+
+func TestMergerBodyBuffers(t *testing.T) {
+	body := "# TYPE requests_total counter\n"
+	for i := 0; i < 1000; i++ {
+		body += fmt.Sprintf("requests_total{id=\"%v\"} 1\n", i)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	m := NewMerger([]PromTarget{{Url: server.URL}}, PromDataOpts{})
+	if _, err := m.Collect(context.Background()); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	buf := m.bodies.get(server.URL)
+	if buf.Cap() < len(body) {
+		t.Errorf("Receive buffer of %v bytes; want the one grown for the %v bytes body", buf.Cap(), len(body))
+	}
+	m.bodies.put(server.URL, buf)
+
+	pd, err := m.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if m.bodies.get(server.URL) != buf || pd.TargetResults[0].BytesRead != len(body) || len(pd.PromMetrics) != 1000 {
+		t.Errorf("Body buffer is not reused, %+v", pd.TargetResults[0])
+	}
+
+	m.Update(nil, PromDataOpts{})
+	if len(m.bodies.buffers) != 0 {
+		t.Errorf("Receive buffers %v of removed targets; want none", m.bodies.buffers)
+	}
+}
+
+func TestMergerBackground(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprintln(w, "slow_metric 1")
+	}))
+	defer slow.Close()
+	defer close(release)
+	var failing atomic.Bool
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "fast_metric 1")
+	}))
+	defer fast.Close()
+
+	m := NewMerger([]PromTarget{{Url: slow.URL}, {Url: fast.URL}}, PromDataOpts{
+		ScrapeInterval: 10 * time.Millisecond,
+		StalenessLimit: 100 * time.Millisecond,
+		SupressErrors:  true,
+	})
+	pd, err := m.Snapshot()
+	if err != nil || len(pd.PromMetrics) != 0 || !errors.Is(pd.TargetResults[0].Err, ErrNotScraped) {
+		t.Fatalf("Receive %v, %+v before the first scrape; want no metrics", err, pd.TargetResults)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	waitSnapshot := func(condition func(pd *PromData) bool) *PromData {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			pd, err := m.Snapshot()
+			if err != nil {
+				t.Fatalf("Receive %v; want nil", err)
+			}
+			if condition(pd) {
+				return pd
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Snapshot condition is not met")
+		return nil
+	}
+
+	// The fast target is served while the slow one is still being scraped
+	pd = waitSnapshot(func(pd *PromData) bool { return pd.ToString() == "fast_metric 1\n" })
+	if !errors.Is(pd.TargetResults[0].Err, ErrNotScraped) || pd.TargetResults[1].Err != nil {
+		t.Errorf("Unexpected target results %+v", pd.TargetResults)
+	}
+
+	// Series of a failing target are served until they become stale
+	failing.Store(true)
+	pd = waitSnapshot(func(pd *PromData) bool { return pd.TargetResults[1].Err != nil })
+	if output := pd.ToString(); output != "fast_metric 1\n" {
+		t.Errorf("Receive %v; want the last scraped metrics", output)
+	}
+	pd = waitSnapshot(func(pd *PromData) bool { return len(pd.PromMetrics) == 0 })
+	if !strings.Contains(pd.TargetResults[1].Err.Error(), "response code") {
+		t.Errorf("Receive %v; want the scrape error", pd.TargetResults[1].Err)
+	}
+
+	// Updated targets are scraped without waiting for the next round
+	m.Update([]PromTarget{{Url: slow.URL}}, PromDataOpts{ScrapeInterval: time.Hour, SupressErrors: true})
+	failing.Store(false)
+	m.Update([]PromTarget{{Url: fast.URL, ExtraLabels: []string{`app="fast"`}}}, PromDataOpts{ScrapeInterval: time.Hour, SupressErrors: true})
+	waitSnapshot(func(pd *PromData) bool { return pd.ToString() == `fast_metric{app="fast"} 1`+"\n" })
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run does not return after cancellation")
+	}
+}
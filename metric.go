@@ -3,12 +3,13 @@ package prommerge
 import (
 	"bufio"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"log/slog"
-
-	"os"
+	"math"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type PromMetric struct {
@@ -16,99 +17,457 @@ type PromMetric struct {
 	LabelList []string
 	Output    string
 	Value     float64
-	Help      string
-	Type      string
-	sort      string
+	// Help and Type are the HELP and TYPE lines of the sample family, they are set only by ParseMetricData,
+	// MetricFamily holds the parsed metadata
+	Help string
+	Type string
+	// Timestamp is the optional sample timestamp in milliseconds since epoch, set if HasTimestamp
+	Timestamp    int64
+	HasTimestamp bool
+	// Exemplar is the OpenMetrics exemplar of the sample, nil if absent
+	Exemplar *Exemplar
+	// Created is the created timestamp of counters, histograms and summaries, zero if absent
+	Created time.Time
+	// NativeHistogram is set for the native part of a histogram scraped over protobuf,
+	// such samples are written only by WriteProtobuf
+	NativeHistogram *NativeHistogram
+	// target is the name of the target the sample was scraped from
+	target string
+}
+
+// ParseError describes a line of the exposition that could not be parsed
+type ParseError struct {
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at line %v: %v", e.Line, e.Err)
 }
 
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseMetricData parses the text exposition into samples, malformed lines are skipped and families
+// rejected by MetricFilter are left out. Help and Type of the samples are set to the HELP and TYPE lines
+// of their family unless OmitMeta is set. Errors are logged, see ParseMetricFamilies.
 func (pd *PromData) ParseMetricData(in string, extraLabels []string) []*PromMetric {
-	var metrics []*PromMetric
-	helpMap := make(map[string]string)
-	typeMap := make(map[string]string)
+	families, _, err := pd.ParseMetricFamilies(in, extraLabels)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+	metrics := make([]*PromMetric, 0, countSamples(families))
+	for _, f := range families {
+		var help, typ string
+		if f.Help != "" && !pd.OmitMeta {
+			help = fmt.Sprintf("# HELP %v %v", f.Name, helpEscaper.Replace(f.Help))
+		}
+		if f.Type.classic() && !pd.OmitMeta {
+			typ = fmt.Sprintf("# TYPE %v %v", f.Name, f.Type)
+		}
+		for _, p := range f.Metrics {
+			p.Help, p.Type = help, typ
+			metrics = append(metrics, p)
+		}
+	}
+	return metrics
+}
+
+// ParseMetricFamilies parses the text exposition into metric families and returns the number of skipped
+// malformed lines, with StrictParsing the first malformed line is returned as *ParseError instead
+func (pd *PromData) ParseMetricFamilies(in string, extraLabels []string) ([]*MetricFamily, int, error) {
+	return pd.parseMetricData(in, extraLabels, pd.newNameFilter(MetricFilter{}))
+}
+
+// parseMetricData parses the text exposition. Malformed lines are skipped and counted,
+// unless StrictParsing is set, in which case the first one is returned as *ParseError.
+// Samples are grouped into families by the TYPE lines, so _bucket, _sum and _count series
+// of histograms and summaries stay with their family. Lines of families the filter rejects are not parsed.
+func (pd *PromData) parseMetricData(in string, extraLabels []string, filter *nameFilter) ([]*MetricFamily, int, error) {
+	var badLines int
+	builder := newFamilyBuilder()
 	scanner := bufio.NewScanner(strings.NewReader(in))
+	scanner.Buffer(nil, MaxLineSize)
+
+	lineNum := 0
+	badLine := func(line string, err error) error {
+		if pd.StrictParsing {
+			return &ParseError{Line: lineNum, Text: line, Err: err}
+		}
+		slog.Debug("Skip bad line", slog.Int("line", lineNum), slog.String("err", err.Error()))
+		badLines++
+		return nil
+	}
 
 	for scanner.Scan() {
+		lineNum++
 		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
 		if len(line) > 6 && line[0:6] == "# HELP" {
-			if pd.OmitMeta {
-				continue
-			}
 			//log.Debugf("Metadata help %v", line)
 			matches := helpRe.FindStringSubmatch(line)
-			if matches == nil || len(matches) < 2 {
-				log.Warnf("No matches found for the help input %v", line)
+			if matches == nil {
+				if err := badLine(line, fmt.Errorf("no matches found for the help input %v", line)); err != nil {
+					return nil, badLines, err
+				}
+				continue
 			}
-			helpMap[matches[1]] = matches[0]
+			builder.family(matches[1]).Help = helpUnescaper.Replace(matches[2])
 			continue
 		}
 		if len(line) > 6 && line[0:6] == "# TYPE" {
-			if pd.OmitMeta {
-				continue
-			}
 			//log.Debugf("Metadata type %v", line)
 			matches := typeRe.FindStringSubmatch(line)
-			if matches == nil || len(matches) < 2 {
-				log.Warnf("No matches found for the type input %v", line)
+			if matches == nil {
+				if err := badLine(line, fmt.Errorf("no matches found for the type input %v", line)); err != nil {
+					return nil, badLines, err
+				}
+				continue
 			}
-			typeMap[matches[1]] = matches[0]
+			typ, ok := ParseMetricType(matches[2])
+			if !ok {
+				if err := badLine(line, fmt.Errorf("unknown metric type %v", matches[2])); err != nil {
+					return nil, badLines, err
+				}
+				continue
+			}
+			builder.family(matches[1]).Type = typ
+			continue
+		}
+		if line[0] == '#' {
+			// Plain comment
 			continue
 		}
 
+		if filter != nil && !filter.allows(builder.familyName(sampleName(line))) {
+			continue
+		}
 		p, err := pd.MetricParser(line, extraLabels)
 		if err != nil {
-			slog.Error(err.Error())
-			return nil
+			if err := badLine(line, err); err != nil {
+				return nil, badLines, err
+			}
+			continue
 		}
-		p.Help = helpMap[p.Name]
-		p.Type = typeMap[p.Name]
-		metrics = append(metrics, p)
+		builder.add(p)
 		//log.Debugf("Metric: %+v", p)
 	}
 
 	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading input:", err)
+		return nil, badLines, fmt.Errorf("reading input: %v", err)
 	}
-	return metrics
+	return builder.result(), badLines, nil
 }
 
 func (pd *PromData) MetricParser(input string, extraLabels []string) (*PromMetric, error) {
-	p := new(PromMetric)
-	matches := metricRe.FindStringSubmatch(input)
-	if matches == nil {
-		return nil, fmt.Errorf("no matches found for the input %v", input)
+	p, rest, err := parseSeries(input, extraLabels)
+	if err != nil {
+		return nil, err
 	}
 
-	//log.Debugf("Metric Name: %v", matches[1])
-	p.Name = matches[1]
-	//log.Debugf("Labels: %v", matches[2])
-	labelPairs := strings.Split(matches[2], ",")
-	for _, labelPair := range extraLabels {
-		kv := strings.Split(labelPair, "=")
-		if len(kv) == 2 {
-			p.LabelList = append(p.LabelList, kv[0], strings.ReplaceAll(kv[1], `"`, ""))
+	matches := valueRe.FindStringSubmatch(rest)
+	if matches == nil {
+		return nil, fmt.Errorf("no value found for the input %v", input)
+	}
+	value, err := ParseValue(matches[1])
+	if err != nil {
+		return nil, err
+	}
+	//log.Debugf("Value: %v", value)
+	p.Value = value
+	if matches[2] != "" {
+		p.Timestamp, err = strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing timestamp, %v", err)
 		}
+		p.HasTimestamp = true
 	}
 
+	return p, nil
+}
+
+// parseSeries parses the metric name and label set of a sample line, the rest of the line is returned as is
+func parseSeries(input string, extraLabels []string) (*PromMetric, string, error) {
+	p := new(PromMetric)
+	p.Name = metricRe.FindString(input)
+	if p.Name == "" {
+		return nil, "", fmt.Errorf("no matches found for the input %v", input)
+	}
+	p.LabelList = append(p.LabelList, ExtraLabelList(extraLabels)...)
+
 	// Parse labels
-	for i, _ := range labelPairs {
-		m := labelRe.FindStringSubmatch(labelPairs[i])
-		if m == nil {
-			log.Debugf("Metric %v has no labels", p.Name)
+	rest := input[len(p.Name):]
+	if strings.HasPrefix(rest, "{") {
+		labelList, n, err := ParseLabels(rest)
+		if err != nil {
+			return nil, "", fmt.Errorf("error parsing labels of %v, %v", p.Name, err)
+		}
+		p.LabelList = append(p.LabelList, labelList...)
+		rest = rest[n:]
+	}
+	return p, rest, nil
+}
+
+// ParseValue parses a sample value, accepting every float form of the text format
+// including NaN, +Inf and -Inf, but not hexadecimal floats
+func ParseValue(s string) (float64, error) {
+	if strings.ContainsAny(s, "xX_") {
+		return 0, fmt.Errorf("error parsing float, invalid value %v", s)
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing float, %v", err)
+	}
+	return value, nil
+}
+
+// FormatValue formats a sample value the way Prometheus does, special values are written as NaN, +Inf and -Inf
+func FormatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ParseLabels parses a `{name="value",...}` label set at the beginning of the input
+// and returns the unescaped label list with the number of bytes consumed
+func ParseLabels(input string) ([]string, int, error) {
+	var labelList []string
+	if !strings.HasPrefix(input, "{") {
+		return nil, 0, fmt.Errorf("label set must start with '{'")
+	}
+	i := 1
+	skipSpaces := func() {
+		for i < len(input) && (input[i] == ' ' || input[i] == '\t') {
+			i++
+		}
+	}
+	for {
+		skipSpaces()
+		if i >= len(input) {
+			return nil, 0, fmt.Errorf("unexpected end of label set")
+		}
+		if input[i] == '}' {
+			return labelList, i + 1, nil
+		}
+
+		// Label name
+		start := i
+		for i < len(input) && isLabelNameChar(input[i], i == start) {
+			i++
+		}
+		if i == start {
+			return nil, 0, fmt.Errorf("invalid label name at position %v", i)
+		}
+		name := input[start:i]
+		skipSpaces()
+		if i >= len(input) || input[i] != '=' {
+			return nil, 0, fmt.Errorf("expected '=' after label %v", name)
+		}
+		i++
+		skipSpaces()
+		if i >= len(input) || input[i] != '"' {
+			return nil, 0, fmt.Errorf("expected '\"' to open value of label %v", name)
+		}
+		i++
+
+		// Quoted label value
+		var value strings.Builder
+		closed := false
+		for i < len(input) && !closed {
+			c := input[i]
+			i++
+			switch c {
+			case '"':
+				closed = true
+			case '\\':
+				if i >= len(input) {
+					return nil, 0, fmt.Errorf("unexpected end of value of label %v", name)
+				}
+				switch input[i] {
+				case '\\', '"':
+					value.WriteByte(input[i])
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					return nil, 0, fmt.Errorf("invalid escape sequence '\\%c' in value of label %v", input[i], name)
+				}
+				i++
+			default:
+				value.WriteByte(c)
+			}
+		}
+		if !closed {
+			return nil, 0, fmt.Errorf("unterminated value of label %v", name)
+		}
+		labelList = append(labelList, name, value.String())
+
+		skipSpaces()
+		if i < len(input) && input[i] == ',' {
+			i++
 			continue
 		}
-		if len(m) > 2 {
-			p.LabelList = append(p.LabelList, m[1], m[2])
+		if i < len(input) && input[i] == '}' {
+			continue
 		}
+		return nil, 0, fmt.Errorf("expected ',' or '}' after value of label %v", name)
 	}
-	value, err := strconv.ParseFloat(matches[3], 64)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing float, %v", err)
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// ExtraLabels converts a label set into PromTarget.ExtraLabels, ordered by label name
+func ExtraLabels(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
 	}
-	//log.Debugf("Value: %v", value)
-	p.Value = value
+	slices.Sort(names)
+	extraLabels := make([]string, 0, len(names))
+	for _, name := range names {
+		extraLabels = append(extraLabels, name+"="+strconv.Quote(labels[name]))
+	}
+	return extraLabels
+}
 
-	if pd.Sort {
-		p.sort = fmt.Sprintf("%v%v", p.Name, p.LabelList)
+// ExtraLabelList converts `name="value"` pairs of PromTarget.ExtraLabels into a label list
+func ExtraLabelList(extraLabels []string) []string {
+	var labelList []string
+	for _, labelPair := range extraLabels {
+		name, value, ok := strings.Cut(labelPair, "=")
+		if !ok {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			labelList = append(labelList, name, unquoted)
+			continue
+		}
+		labelList = append(labelList, name, strings.ReplaceAll(value, `"`, ""))
 	}
-	return p, nil
+	return labelList
+}
+
+// resolveLabelCollisions handles scraped labels colliding with the extra labels the list starts with,
+// extra is the length of that prefix. With honorLabels the scraped value wins and the extra label is dropped,
+// otherwise the scraped label is renamed to exported_<name> as Prometheus does. The list is returned
+// unchanged if nothing collides.
+func resolveLabelCollisions(labelList []string, extra int, honorLabels bool) []string {
+	collides := func(name string, labels []string) bool {
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i] == name {
+				return true
+			}
+		}
+		return false
+	}
+	extraLabels, scraped := labelList[:extra], labelList[extra:]
+	found := false
+	for i := 0; i+1 < len(scraped) && !found; i += 2 {
+		found = collides(scraped[i], extraLabels)
+	}
+	if !found {
+		return labelList
+	}
+
+	result := make([]string, 0, len(labelList))
+	if honorLabels {
+		for i := 0; i+1 < len(extraLabels); i += 2 {
+			if !collides(extraLabels[i], scraped) {
+				result = append(result, extraLabels[i], extraLabels[i+1])
+			}
+		}
+		return append(result, scraped...)
+	}
+	result = append(result, extraLabels...)
+	for i := 0; i+1 < len(scraped); i += 2 {
+		name := scraped[i]
+		for collides(name, extraLabels) || (name != scraped[i] && collides(name, scraped)) {
+			name = "exported_" + name
+		}
+		result = append(result, name, scraped[i+1])
+	}
+	return result
+}
+
+// BuildTargetMetrics generates up, scrape_duration_seconds and scrape_samples_scraped families
+// with a series for every target from the last collection results. The series carry the extra labels
+// of the target and, unless they have one, an instance label as Prometheus does, see targetInstance.
+func (pd *PromData) BuildTargetMetrics() []*MetricFamily {
+	definitions := []struct {
+		name  string
+		help  string
+		value func(res TargetResult) float64
+	}{
+		{"up", "1 if the target was scraped successfully, 0 otherwise.", func(res TargetResult) float64 {
+			if res.Err != nil || res.StatusCode < 200 || res.StatusCode > 299 {
+				return 0
+			}
+			return 1
+		}},
+		{"scrape_duration_seconds", "Duration of the target scrape in seconds.", func(res TargetResult) float64 {
+			return res.Duration.Seconds()
+		}},
+		{"scrape_samples_scraped", "Number of samples scraped from the target.", func(res TargetResult) float64 {
+			return float64(res.Samples)
+		}},
+	}
+
+	labels := make([][]string, len(pd.TargetResults))
+	for i := range pd.TargetResults {
+		labels[i] = ExtraLabelList(pd.PromTargets[i].ExtraLabels)
+		if !slices.Contains(labelNames(labels[i]), "instance") {
+			labels[i] = append(labels[i], "instance", targetInstance(pd.PromTargets[i]))
+		}
+	}
+
+	var families []*MetricFamily
+	for _, definition := range definitions {
+		f := &MetricFamily{Name: definition.name, Help: definition.help, Type: MetricTypeGauge}
+		for i, res := range pd.TargetResults {
+			p := &PromMetric{
+				Name:      definition.name,
+				LabelList: slices.Clip(labels[i]),
+				Value:     definition.value(res),
+				target:    res.target(),
+			}
+			f.Metrics = append(f.Metrics, p)
+			f.targets = append(f.targets, p.target)
+		}
+		families = append(families, f)
+	}
+	return families
+}
+
+// targetInstance identifies a target in its synthetic series, the target name or the host of its URL
+func targetInstance(target PromTarget) string {
+	if target.Name != "" {
+		return target.Name
+	}
+	if u, err := url.Parse(target.Url); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return target.Url
+}
+
+// labelNames returns the names of a name, value label list
+func labelNames(labelList []string) []string {
+	names := make([]string, 0, len(labelList)/2)
+	for i := 0; i+1 < len(labelList); i += 2 {
+		names = append(names, labelList[i])
+	}
+	return names
 }
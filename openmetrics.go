@@ -0,0 +1,441 @@
+package prommerge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OpenMetricsContentType = "application/openmetrics-text"
+	// OpenMetricsAcceptHeader prefers the OpenMetrics format and falls back to AcceptHeader
+	OpenMetricsAcceptHeader = `application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,` + AcceptHeader
+)
+
+// Exemplar is an OpenMetrics exemplar attached to a sample
+type Exemplar struct {
+	LabelList []string
+	Value     float64
+	// Timestamp is the optional exemplar timestamp in milliseconds since epoch, set if HasTimestamp
+	Timestamp    int64
+	HasTimestamp bool
+}
+
+type openMetricsFamily struct {
+	typ  string
+	help string
+	unit string
+}
+
+// openMetricsSuffixes lists sample name suffixes allowed for every OpenMetrics family type
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"_count", "_sum", "_created"},
+	"info":           {"_info"},
+}
+
+// IsOpenMetrics reports whether the Content-Type header value denotes the OpenMetrics text format
+func IsOpenMetrics(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == OpenMetricsContentType
+}
+
+// parseTargetData parses a target body with the parser matching its content type
+func (pd *PromData) parseTargetData(in string, contentType string, extraLabels []string, filter *nameFilter) ([]*MetricFamily, int, error) {
+	if IsOpenMetrics(contentType) {
+		return pd.parseOpenMetricsData(in, extraLabels, filter)
+	}
+	if IsProtobuf(contentType) {
+		return pd.parseProtobufData(in, extraLabels, filter)
+	}
+	return pd.parseMetricData(in, extraLabels, filter)
+}
+
+// parseOpenMetricsData parses the OpenMetrics text format into families the classic format is able to render.
+// Counter families are named after their _total samples, _created series are folded into PromMetric.Created
+// and exemplars are kept in PromMetric.Exemplar.
+func (pd *PromData) parseOpenMetricsData(in string, extraLabels []string, filter *nameFilter) ([]*MetricFamily, int, error) {
+	var metrics []*PromMetric
+	var badLines int
+	families := make(map[string]*openMetricsFamily)
+	scanner := bufio.NewScanner(strings.NewReader(in))
+	scanner.Buffer(nil, MaxLineSize)
+
+	lineNum := 0
+	eof := false
+	badLine := func(line string, err error) error {
+		if pd.StrictParsing {
+			return &ParseError{Line: lineNum, Text: line, Err: err}
+		}
+		slog.Debug("Skip bad line", slog.Int("line", lineNum), slog.String("err", err.Error()))
+		badLines++
+		return nil
+	}
+	family := func(name string) *openMetricsFamily {
+		if families[name] == nil {
+			families[name] = &openMetricsFamily{typ: "unknown"}
+		}
+		return families[name]
+	}
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if eof {
+			if err := badLine(line, fmt.Errorf("unexpected content after # EOF")); err != nil {
+				return nil, badLines, err
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 || fields[0] != "#" {
+				// Plain comment
+				continue
+			}
+			text := ""
+			if len(fields) == 4 {
+				text = fields[3]
+			}
+			switch fields[1] {
+			case "HELP":
+				family(fields[2]).help = openMetricsHelpUnescaper.Replace(text)
+			case "TYPE":
+				if _, ok := ParseMetricType(text); !ok {
+					if err := badLine(line, fmt.Errorf("unknown metric type %v", text)); err != nil {
+						return nil, badLines, err
+					}
+					continue
+				}
+				family(fields[2]).typ = text
+			case "UNIT":
+				family(fields[2]).unit = text
+			}
+			continue
+		}
+
+		p, err := pd.openMetricsParser(line, extraLabels)
+		if err != nil {
+			if err := badLine(line, err); err != nil {
+				return nil, badLines, err
+			}
+			continue
+		}
+		metrics = append(metrics, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, badLines, fmt.Errorf("reading input: %v", err)
+	}
+	if !eof {
+		if err := badLine("", fmt.Errorf("missing # EOF")); err != nil {
+			return nil, badLines, err
+		}
+	}
+
+	// Fold _created series into the samples they belong to
+	created := make(map[string]time.Time)
+	result := metrics[:0]
+	for _, p := range metrics {
+		name := openMetricsFamilyName(p.Name, families)
+		if p.Name == name+"_created" {
+			created[name+seriesKey(p.LabelList)] = p.Created
+			continue
+		}
+		result = append(result, p)
+	}
+	builder := newFamilyBuilder()
+	for _, p := range result {
+		name := openMetricsFamilyName(p.Name, families)
+		f := families[name]
+		if f == nil {
+			if filter.allows(builder.familyName(p.Name)) {
+				builder.add(p)
+			}
+			continue
+		}
+		if c, ok := created[name+seriesKey(p.LabelList)]; ok && (p.Name == name+"_total" || p.Name == name+"_count") {
+			p.Created = c
+		}
+		familyName := name
+		switch f.typ {
+		case "counter":
+			familyName = name + "_total"
+		case "info":
+			familyName = name + "_info"
+		}
+		if !filter.allows(familyName) {
+			continue
+		}
+		mf := builder.family(familyName)
+		if len(mf.Metrics) == 0 {
+			mf.Type, _ = ParseMetricType(f.typ)
+			mf.Help = f.help
+			mf.Unit = f.unit
+		}
+		mf.Metrics = append(mf.Metrics, p)
+	}
+	return builder.result(), badLines, nil
+}
+
+// openMetricsParser parses an OpenMetrics sample line with an optional timestamp in seconds and exemplar
+func (pd *PromData) openMetricsParser(input string, extraLabels []string) (*PromMetric, error) {
+	p, rest, err := parseSeries(input, extraLabels)
+	if err != nil {
+		return nil, err
+	}
+
+	sample, exemplar, hasExemplar := strings.Cut(rest, " # ")
+	fields := strings.Fields(sample)
+	if len(fields) == 0 || len(fields) > 2 || !strings.HasPrefix(sample, " ") {
+		return nil, fmt.Errorf("no value found for the input %v", input)
+	}
+	p.Value, err = ParseValue(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(p.Name, "_created") {
+		// Kept at full precision in case the sample turns out to be a created timestamp
+		p.Created = parseOpenMetricsCreated(fields[0], p.Value)
+	}
+	if len(fields) == 2 {
+		p.Timestamp, err = parseOpenMetricsTimestamp(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		p.HasTimestamp = true
+	}
+
+	if hasExemplar {
+		labelList, n, err := ParseLabels(strings.TrimLeft(exemplar, " "))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing exemplar labels of %v, %v", p.Name, err)
+		}
+		fields := strings.Fields(strings.TrimLeft(exemplar, " ")[n:])
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("no exemplar value found for the input %v", input)
+		}
+		p.Exemplar = &Exemplar{LabelList: labelList}
+		p.Exemplar.Value, err = ParseValue(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 2 {
+			p.Exemplar.Timestamp, err = parseOpenMetricsTimestamp(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			p.Exemplar.HasTimestamp = true
+		}
+	}
+
+	return p, nil
+}
+
+// parseOpenMetricsTimestamp converts an OpenMetrics timestamp in seconds into milliseconds
+func parseOpenMetricsTimestamp(s string) (int64, error) {
+	ts, err := ParseValue(s)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, fmt.Errorf("error parsing timestamp %v", s)
+	}
+	return int64(math.Round(ts * 1000)), nil
+}
+
+// parseOpenMetricsCreated converts a created timestamp in seconds into a time without going through
+// float64, which can't hold nanoseconds of current times. value is the parsed s used for other notations.
+func parseOpenMetricsCreated(s string, value float64) time.Time {
+	seconds, fraction, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err == nil && !strings.HasPrefix(s, "-") && len(fraction) <= 9 && strings.Trim(fraction, "0123456789") == "" {
+		nsec, _ := strconv.ParseInt(fraction+strings.Repeat("0", 9-len(fraction)), 10, 64)
+		return time.Unix(sec, nsec)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return time.Time{}
+	}
+	sec64, frac := math.Modf(value)
+	return time.Unix(int64(sec64), int64(math.Round(frac*1e9)))
+}
+
+// formatOpenMetricsCreated converts a created timestamp into OpenMetrics seconds
+func formatOpenMetricsCreated(created time.Time) string {
+	if created.Unix() < 0 {
+		return strconv.FormatFloat(float64(created.UnixNano())/1e9, 'f', -1, 64)
+	}
+	s := strconv.FormatInt(created.Unix(), 10)
+	if nsec := created.Nanosecond(); nsec != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", nsec), "0")
+	}
+	return s
+}
+
+// openMetricsFamilyName finds the family a sample belongs to by stripping the suffixes its type allows
+func openMetricsFamilyName(name string, families map[string]*openMetricsFamily) string {
+	if _, ok := families[name]; ok {
+		return name
+	}
+	for typ, suffixes := range openMetricsSuffixes {
+		for _, suffix := range suffixes {
+			base, ok := strings.CutSuffix(name, suffix)
+			if ok && families[base] != nil && families[base].typ == typ {
+				return base
+			}
+		}
+	}
+	return name
+}
+
+// seriesKey identifies the series a sample belongs to, bucket and quantile labels are ignored
+func seriesKey(labelList []string) string {
+	var key strings.Builder
+	for i := 0; i+1 < len(labelList); i += 2 {
+		if labelList[i] == "le" || labelList[i] == "quantile" {
+			continue
+		}
+		key.WriteString(strconv.Quote(labelList[i]))
+		key.WriteString(strconv.Quote(labelList[i+1]))
+	}
+	return key.String()
+}
+
+var helpUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// openMetricsHelpUnescaper also unescapes quotes, which OpenMetrics escapes in HELP text as in label values
+var openMetricsHelpUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+
+// openMetricsTypes maps family types onto the OpenMetrics ones
+var openMetricsTypes = map[MetricType]string{
+	MetricTypeCounter:        "counter",
+	MetricTypeGauge:          "gauge",
+	MetricTypeHistogram:      "histogram",
+	MetricTypeGaugeHistogram: "gaugehistogram",
+	MetricTypeSummary:        "summary",
+}
+
+// ToOpenMetricsString renders the merged metrics in the OpenMetrics text format, see WriteOpenMetrics
+func (pd *PromData) ToOpenMetricsString() string {
+	var buffer strings.Builder
+	if _, err := pd.WriteOpenMetrics(&buffer); err != nil {
+		slog.Error("Failed to render OpenMetrics", slog.String("err", err.Error()))
+	}
+	return buffer.String()
+}
+
+// WriteOpenMetrics streams the merged metrics in the OpenMetrics text format to w through a pooled buffer.
+// Counter families lose their _total suffix, created timestamps and exemplars are written back.
+func (pd *PromData) WriteOpenMetrics(w io.Writer) (int64, error) {
+	t := time.Now()
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+
+	var n int64
+	var line []byte
+	write := func() error {
+		written, err := bw.Write(line)
+		n += int64(written)
+		return err
+	}
+	for _, f := range pd.MetricFamilies {
+		name, typ := f.Name, openMetricsTypes[f.Type]
+		if typ == "" {
+			typ = "unknown"
+		}
+		if f.Type == MetricTypeCounter {
+			name = strings.TrimSuffix(f.Name, "_total")
+		}
+		line = line[:0]
+		if f.Help != "" {
+			line = fmt.Appendf(line, "# HELP %v %v\n", name, labelValueEscaper.Replace(f.Help))
+		}
+		line = fmt.Appendf(line, "# TYPE %v %v\n", name, typ)
+		if f.Unit != "" && strings.HasSuffix(name, "_"+f.Unit) {
+			line = fmt.Appendf(line, "# UNIT %v %v\n", name, f.Unit)
+		}
+		if err := write(); err != nil {
+			return n, err
+		}
+		for _, p := range f.Metrics {
+			if p.NativeHistogram != nil {
+				continue
+			}
+			line = pd.appendOpenMetricsSample(line[:0], name, f.Type, p)
+			if err := write(); err != nil {
+				return n, err
+			}
+		}
+	}
+	line = append(line[:0], "# EOF\n"...)
+	if err := write(); err != nil {
+		return n, err
+	}
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	pd.OutputProcessDuration = time.Since(t)
+	slog.Debug("OpenMetrics output written", slog.Int("bytes", int(n)), slog.String("duration", pd.OutputProcessDuration.String()))
+	return n, nil
+}
+
+// appendOpenMetricsSample renders a sample of the named family into buf along with its exemplar
+// and the _created sample that follows it
+func (pd *PromData) appendOpenMetricsSample(buf []byte, name string, typ MetricType, p *PromMetric) []byte {
+	sampleName := p.Name
+	if typ == MetricTypeCounter {
+		sampleName = name + "_total"
+	}
+	buf = append(buf, sampleName...)
+	buf = appendLabels(buf, p.LabelList)
+	buf = append(buf, ' ')
+	buf = append(buf, FormatValue(p.Value)...)
+	if p.HasTimestamp && !pd.OmitTimestamps {
+		buf = append(buf, ' ')
+		buf = append(buf, formatOpenMetricsTimestamp(p.Timestamp)...)
+	}
+	if p.Exemplar != nil && (sampleName == name+"_total" || sampleName == name+"_bucket") {
+		buf = append(buf, " # "...)
+		buf = appendLabels(buf, p.Exemplar.LabelList)
+		if len(p.Exemplar.LabelList) == 0 {
+			buf = append(buf, "{}"...)
+		}
+		buf = append(buf, ' ')
+		buf = append(buf, FormatValue(p.Exemplar.Value)...)
+		if p.Exemplar.HasTimestamp {
+			buf = append(buf, ' ')
+			buf = append(buf, formatOpenMetricsTimestamp(p.Exemplar.Timestamp)...)
+		}
+	}
+	buf = append(buf, '\n')
+	if !p.Created.IsZero() && (sampleName == name+"_total" || sampleName == name+"_count") {
+		var labelList []string
+		for i := 0; i+1 < len(p.LabelList); i += 2 {
+			if p.LabelList[i] != "le" && p.LabelList[i] != "quantile" {
+				labelList = append(labelList, p.LabelList[i], p.LabelList[i+1])
+			}
+		}
+		buf = fmt.Appendf(buf, "%v_created%v %v\n", name, FormatLabels(labelList), formatOpenMetricsCreated(p.Created))
+	}
+	return buf
+}
+
+// formatOpenMetricsTimestamp converts a timestamp in milliseconds into OpenMetrics seconds
+func formatOpenMetricsTimestamp(ts int64) string {
+	return strconv.FormatFloat(float64(ts)/1000, 'f', -1, 64)
+}
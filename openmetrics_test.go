@@ -0,0 +1,285 @@
+package prommerge
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const openMetricsFixture = `# HELP http_requests Total HTTP requests.
+# TYPE http_requests counter
+http_requests_total{path="/a"} 10 # {trace_id="abc"} 1 1712345678.5
+http_requests_created{path="/a"} 1712340000.5
+# HELP request_duration_seconds Request duration.
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="0.1"} 3
+request_duration_seconds_bucket{le="+Inf"} 4
+request_duration_seconds_count 4
+request_duration_seconds_sum 1.5
+request_duration_seconds_created 1712340000
+# TYPE temperature gauge
+temperature 21.5 1712345678.123
+# EOF
+`
+
+func TestParseOpenMetricsData(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{})
+	families, badLines, err := pd.parseOpenMetricsData(openMetricsFixture, []string{`app="api"`}, nil)
+	if err != nil || badLines != 0 {
+		t.Fatalf("Receive %v and %v bad lines; want nil", err, badLines)
+	}
+	if len(families) != 3 {
+		t.Fatalf("Receive %v families; want 3", len(families))
+	}
+
+	requests := families[0]
+	if requests.Name != "http_requests_total" || requests.Type != MetricTypeCounter || requests.Help != "Total HTTP requests." {
+		t.Errorf("Unexpected counter family %+v", requests)
+	}
+	counter := requests.Metrics[0]
+	if counter.Name != "http_requests_total" || counter.Value != 10 || !counter.Created.Equal(time.Unix(1712340000, 5e8)) {
+		t.Errorf("Unexpected counter %+v", counter)
+	}
+	if counter.Exemplar == nil || fmt.Sprint(counter.Exemplar.LabelList) != "[trace_id abc]" || counter.Exemplar.Value != 1 || counter.Exemplar.Timestamp != 1712345678500 {
+		t.Errorf("Unexpected exemplar %+v", counter.Exemplar)
+	}
+	if fmt.Sprint(counter.LabelList) != "[app api path /a]" {
+		t.Errorf("Unexpected labels %v", counter.LabelList)
+	}
+
+	duration := families[1]
+	if duration.Name != "request_duration_seconds" || duration.Type != MetricTypeHistogram || duration.Unit != "seconds" || len(duration.Metrics) != 4 {
+		t.Errorf("Unexpected histogram family %+v", duration)
+	}
+	count := duration.Metrics[2]
+	if count.Name != "request_duration_seconds_count" || !count.Created.Equal(time.Unix(1712340000, 0)) {
+		t.Errorf("Unexpected histogram count %+v", count)
+	}
+	if !duration.Metrics[0].Created.IsZero() {
+		t.Errorf("Created timestamp is attached to a bucket")
+	}
+
+	gauge := families[2].Metrics[0]
+	if families[2].Type != MetricTypeGauge || gauge.Name != "temperature" || gauge.Timestamp != 1712345678123 {
+		t.Errorf("Unexpected gauge %+v", gauge)
+	}
+
+	_, badLines, _ = pd.parseOpenMetricsData(strings.TrimSuffix(openMetricsFixture, "# EOF\n"), nil, nil)
+	if badLines != 1 {
+		t.Errorf("Receive %v bad lines for missing # EOF; want 1", badLines)
+	}
+}
+
+func TestParseOpenMetricsHelp(t *testing.T) {
+	input := `# HELP jobs Jobs in C:\\tmp, \"quoted\"\nsecond line.
+# TYPE jobs gauge
+jobs 1
+# EOF
+`
+	pd := NewPromData(nil, PromDataOpts{})
+	families, _, err := pd.parseOpenMetricsData(input, nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if help := families[0].Help; help != "Jobs in C:\\tmp, \"quoted\"\nsecond line." {
+		t.Errorf("Receive help %q", help)
+	}
+	pd.mergeFamilies(families)
+	pd.flattenFamilies()
+	expected := `# HELP jobs Jobs in C:\\tmp, "quoted"\nsecond line.
+# TYPE jobs gauge
+jobs 1
+`
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+	if output := pd.ToOpenMetricsString(); output != input {
+		t.Errorf("Receive\n%v\nwant\n%v", output, input)
+	}
+}
+
+func TestOpenMetricsZeroTimestamp(t *testing.T) {
+	input := `# TYPE jobs counter
+jobs_total 1 0 # {trace_id="abc"} 1 0
+# EOF
+`
+	pd := NewPromData(nil, PromDataOpts{})
+	families, _, err := pd.parseOpenMetricsData(input, nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	pd.mergeFamilies(families)
+	pd.flattenFamilies()
+	if output := pd.ToOpenMetricsString(); output != input {
+		t.Errorf("Receive\n%v\nwant\n%v", output, input)
+	}
+
+	var buffer bytes.Buffer
+	if err := pd.WriteProtobuf(&buffer); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	decoded, _, err := pd.parseProtobufData(buffer.String(), nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	p := decoded[0].Metrics[0]
+	if !p.HasTimestamp || p.Timestamp != 0 || !p.Exemplar.HasTimestamp {
+		t.Errorf("Zero timestamps are lost in protobuf, %+v %+v", p, p.Exemplar)
+	}
+}
+
+func TestOpenMetricsCreatedPrecision(t *testing.T) {
+	input := `# TYPE jobs counter
+jobs_total 1
+jobs_created 1712340000.123456789
+# EOF
+`
+	pd := NewPromData(nil, PromDataOpts{})
+	families, _, err := pd.parseOpenMetricsData(input, nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if created := families[0].Metrics[0].Created; !created.Equal(time.Unix(1712340000, 123456789)) {
+		t.Errorf("Receive created %v", created.UnixNano())
+	}
+	pd.mergeFamilies(families)
+	pd.flattenFamilies()
+	if output := pd.ToOpenMetricsString(); output != input {
+		t.Errorf("Receive\n%v\nwant\n%v", output, input)
+	}
+
+	var buffer bytes.Buffer
+	if err := pd.WriteProtobuf(&buffer); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	decoded, _, err := pd.parseProtobufData(buffer.String(), nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if created := decoded[0].Metrics[0].Created; !created.Equal(time.Unix(1712340000, 123456789)) {
+		t.Errorf("Receive created %v from protobuf", created.UnixNano())
+	}
+}
+
+func TestCollectOpenMetricsTarget(t *testing.T) {
+	var accept string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		fmt.Fprint(w, openMetricsFixture)
+	}))
+	defer target.Close()
+
+	pd := NewPromData([]PromTarget{{Url: target.URL, ExtraLabels: []string{`app="om"`}}}, PromDataOpts{PreferOpenMetrics: true})
+	err := pd.CollectTargets()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if !strings.HasPrefix(accept, OpenMetricsContentType) {
+		t.Errorf("Receive Accept %v; want OpenMetrics first", accept)
+	}
+	result := pd.ToString()
+	expected := "# HELP http_requests_total Total HTTP requests.\n# TYPE http_requests_total counter\n" +
+		`http_requests_total{app="om",path="/a"} 10` + "\n"
+	if !strings.Contains(result, expected) {
+		t.Errorf("Receive %v; want %v", result, expected)
+	}
+	if strings.Contains(result, "_created") || strings.Contains(result, "EOF") {
+		t.Errorf("OpenMetrics specific lines leak into the text output %v", result)
+	}
+
+	// The classic text format is asked for by default, OpenMetrics responses are parsed anyway
+	pd = NewPromData([]PromTarget{{Url: target.URL}}, PromDataOpts{})
+	if err := pd.CollectTargets(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if accept != AcceptHeader || len(pd.MetricFamilies) != 3 {
+		t.Errorf("Receive Accept %v and %v families; want %v and 3", accept, len(pd.MetricFamilies), AcceptHeader)
+	}
+}
+
+func TestToOpenMetricsString(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{})
+	families, _, err := pd.parseOpenMetricsData(openMetricsFixture, []string{`app="api"`}, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	classic, _, err := pd.parseMetricData(strings.Join([]string{
+		"# HELP jobs_done Jobs done.",
+		"# TYPE jobs_done counter",
+		"jobs_done 3",
+		"# TYPE rpc_seconds summary",
+		`rpc_seconds{quantile="0.5"} NaN`,
+		"rpc_seconds_sum 0",
+		"rpc_seconds_count 0",
+	}, "\n"), []string{`app="web"`}, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	pd.mergeFamilies(append(families, classic...))
+
+	expected := `# HELP http_requests Total HTTP requests.
+# TYPE http_requests counter
+http_requests_total{app="api",path="/a"} 10 # {trace_id="abc"} 1 1712345678.5
+http_requests_created{app="api",path="/a"} 1712340000.5
+# HELP request_duration_seconds Request duration.
+# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{app="api",le="0.1"} 3
+request_duration_seconds_bucket{app="api",le="+Inf"} 4
+request_duration_seconds_count{app="api"} 4
+request_duration_seconds_created{app="api"} 1712340000
+request_duration_seconds_sum{app="api"} 1.5
+# TYPE temperature gauge
+temperature{app="api"} 21.5 1712345678.123
+# HELP jobs_done Jobs done.
+# TYPE jobs_done counter
+jobs_done_total{app="web"} 3
+# TYPE rpc_seconds summary
+rpc_seconds{app="web",quantile="0.5"} NaN
+rpc_seconds_sum{app="web"} 0
+rpc_seconds_count{app="web"} 0
+# EOF
+`
+	if output := pd.ToOpenMetricsString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+}
+
+func TestWriteOpenMetricsGaugeHistogram(t *testing.T) {
+	input := `# HELP queue_size Queued jobs.
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="10"} 2
+queue_size_bucket{le="+Inf"} 3
+queue_size_gsum 14
+queue_size_gcount 3
+# EOF
+`
+	pd := NewPromData(nil, PromDataOpts{})
+	families, _, err := pd.parseOpenMetricsData(input, nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if len(families) != 1 || families[0].Type != MetricTypeGaugeHistogram || len(families[0].Metrics) != 4 {
+		t.Fatalf("Unexpected families %+v", families)
+	}
+	pd.mergeFamilies(families)
+	pd.sortFamilies()
+
+	var buffer bytes.Buffer
+	n, err := pd.WriteOpenMetrics(&buffer)
+	if err != nil || n != int64(buffer.Len()) {
+		t.Fatalf("Receive %v and %v bytes; want nil and %v", err, n, buffer.Len())
+	}
+	if buffer.String() != input {
+		t.Errorf("Receive\n%v\nwant\n%v", buffer.String(), input)
+	}
+	if text := pd.ToString(); strings.Contains(text, "# TYPE") || !strings.Contains(text, "queue_size_gsum 14\n") {
+		t.Errorf("Receive %v; want gauge histogram samples without TYPE line", text)
+	}
+}
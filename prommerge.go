@@ -1,51 +1,105 @@
 package prommerge
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"sort"
+	"strconv"
 	"time"
 
 	"net/http"
 	"regexp"
+	"slices"
 	"sync"
 )
 
 const (
-	MetricReStr           = `^([\w]+)(?:{(.+?)})? ([0-9.e+-]+)`
-	LabelReStr            = `^([\w]+)="(.+)"`
-	TypeReStr             = `^#\sTYPE\s(\w+)\s.+`
-	HelpReStr             = `^#\sHELP\s(\w+)\s.+`
-	DefaultWorkerPoolSize = 100
+	MetricReStr            = `^([\w]+)(?:{(.+?)})? ([0-9.e+-]+)`
+	LabelReStr             = `^([\w]+)="(.+)"`
+	TypeReStr              = `^#\sTYPE\s(\w+)\s.+`
+	HelpReStr              = `^#\sHELP\s(\w+)\s.+`
+	DefaultWorkerPoolSize  = 100
+	DefaultScrapeInterval  = 15 * time.Second
+	MaxLineSize            = 1024 * 1024
+	AcceptHeader           = `text/plain;version=0.0.4;q=0.5,*/*;q=0.1`
+	DefaultMaxRetryBackoff = time.Minute
+)
+
+// Patterns of the text format parser, they replace MetricReStr, LabelReStr, TypeReStr and HelpReStr,
+// which are kept unchanged for existing users. Any valid metric name is matched, colons included,
+// labels are tokenized by ParseLabels and HELP lines may have no text.
+const (
+	MetricNameReStr = `^[a-zA-Z_:][\w:]*`
+	ValueReStr      = `^[ \t]+(\S+)(?:[ \t]+(-?[0-9]+))?[ \t]*$`
+	HelpLineReStr   = `^#[ \t]+HELP[ \t]+([a-zA-Z_:][\w:]*)(?:[ \t]+(.*))?$`
+	TypeLineReStr   = `^#[ \t]+TYPE[ \t]+([a-zA-Z_:][\w:]*)[ \t]+(\S+)[ \t]*$`
 )
 
 var (
-	metricRe = regexp.MustCompile(MetricReStr)
-	labelRe  = regexp.MustCompile(LabelReStr)
-	typeRe   = regexp.MustCompile(TypeReStr)
-	helpRe   = regexp.MustCompile(HelpReStr)
+	metricRe = regexp.MustCompile(MetricNameReStr)
+	valueRe  = regexp.MustCompile(ValueReStr)
+	typeRe   = regexp.MustCompile(TypeLineReStr)
+	helpRe   = regexp.MustCompile(HelpLineReStr)
 )
 
 type PromDataOpts struct {
 	EmptyOnFailure bool
 	Async          bool
 	Sort           bool
-	OmitMeta       bool
-	SupressErrors  bool
+	// OmitMeta leaves HELP and TYPE lines out of the text output, metadata is still parsed and used for merging
+	OmitMeta      bool
+	SupressErrors bool
+	// StrictParsing fails a target on the first malformed line instead of skipping it
+	StrictParsing bool
+	// PreferProtobuf asks targets for the delimited protobuf format, which is cheaper to parse
+	PreferProtobuf bool
+	// PreferOpenMetrics asks targets for the OpenMetrics format instead of the classic text one. Created
+	// timestamps and gaugehistogram types are kept only by the OpenMetrics and protobuf outputs, the text
+	// output drops them, so enable it only when the merged result is served in one of those formats.
+	PreferOpenMetrics bool
+	// OmitTimestamps drops explicit sample timestamps from the output
+	OmitTimestamps bool
+	// TargetMetrics adds synthetic up, scrape_duration_seconds and scrape_samples_scraped series per target
+	TargetMetrics bool
+	// ConflictPolicy decides how families exposed with different HELP or TYPE are merged
+	ConflictPolicy ConflictPolicy
+	// DuplicatePolicy decides what happens to identical series exposed by several targets
+	DuplicatePolicy DuplicatePolicy
+	// MetricRelabelConfigs are applied to samples of every target after the target own configs
+	MetricRelabelConfigs []RelabelConfig
+	// MetricFilter selects families of every target by name, on top of the target own filter
+	MetricFilter MetricFilter
+	// ScrapeInterval is the pause between background scrapes of Merger.Run, DefaultScrapeInterval if zero
+	ScrapeInterval time.Duration
+	// StalenessLimit drops series of a target from Merger.Snapshot once its last successful background
+	// scrape is older, zero keeps them until the target is removed
+	StalenessLimit time.Duration
 	HTTPClient     *http.Client
 }
 
 func NewPromData(promTargets []PromTarget, opts PromDataOpts) *PromData {
 	pd := &PromData{
-		PromTargets:         promTargets,
-		PromMetricsStream:   make(chan []*PromMetric, 20),
-		MergeWorkerDoneHook: make(chan struct{}),
-		EmptyOnFailure:      opts.EmptyOnFailure,
-		Async:               opts.Async,
-		Sort:                opts.Sort,
-		OmitMeta:            opts.OmitMeta,
-		SupressErrors:       opts.SupressErrors,
+		PromTargets:          promTargets,
+		PromMetricsStream:    make(chan []*MetricFamily, 20),
+		MergeWorkerDoneHook:  make(chan struct{}),
+		EmptyOnFailure:       opts.EmptyOnFailure,
+		Async:                opts.Async,
+		Sort:                 opts.Sort,
+		OmitMeta:             opts.OmitMeta,
+		SupressErrors:        opts.SupressErrors,
+		StrictParsing:        opts.StrictParsing,
+		PreferProtobuf:       opts.PreferProtobuf,
+		PreferOpenMetrics:    opts.PreferOpenMetrics,
+		OmitTimestamps:       opts.OmitTimestamps,
+		TargetMetrics:        opts.TargetMetrics,
+		ConflictPolicy:       opts.ConflictPolicy,
+		DuplicatePolicy:      opts.DuplicatePolicy,
+		MetricRelabelConfigs: opts.MetricRelabelConfigs,
+		MetricFilter:         opts.MetricFilter,
 		workerPoolSize: func() int {
 			if opts.Async {
 				return DefaultWorkerPoolSize
@@ -54,13 +108,23 @@ func NewPromData(promTargets []PromTarget, opts PromDataOpts) *PromData {
 		}(),
 		httpClient: opts.HTTPClient,
 	}
+	if pd.httpClient == nil {
+		pd.httpClient = http.DefaultClient
+	}
 	return pd
 }
 
 type PromData struct {
-	PromMetrics            []*PromMetric
-	PromTargets            []PromTarget
-	PromMetricsStream      chan []*PromMetric
+	// MetricFamilies holds the merged result grouped by family, PromMetrics lists the same samples flat
+	MetricFamilies []*MetricFamily
+	PromMetrics    []*PromMetric
+	PromTargets    []PromTarget
+	TargetResults  []TargetResult
+	// Conflicts lists families the targets exposed with different HELP or TYPE during the last collection
+	Conflicts []MetadataConflict
+	// Duplicates lists series exposed more than once during the last collection, unless DuplicatePolicy is DuplicatePolicyAllow
+	Duplicates             []DuplicateSeries
+	PromMetricsStream      chan []*MetricFamily
 	PromMetricsOutStream   chan string
 	MergeWorkerDoneHook    chan struct{}
 	CollectTargetsDuration time.Duration
@@ -68,44 +132,132 @@ type PromData struct {
 	OutputPrepareDuration  time.Duration
 	OutputProcessDuration  time.Duration
 	OutputGenerateDuration time.Duration
-	workerPoolSize         int
-	httpClient             *http.Client
-	EmptyOnFailure         bool
-	Async                  bool
-	Sort                   bool
-	OmitMeta               bool
-	SupressErrors          bool
+	familyIndex            map[string][]*MetricFamily
+	// scraped holds parsed families of every target by its index until they are merged in target order
+	scraped [][]*MetricFamily
+	// bodyBuffers lends response body buffers of a Merger, a nil pool allocates them for every scrape
+	bodyBuffers          *bodyBufferPool
+	workerPoolSize       int
+	httpClient           *http.Client
+	EmptyOnFailure       bool
+	Async                bool
+	Sort                 bool
+	OmitMeta             bool
+	SupressErrors        bool
+	StrictParsing        bool
+	PreferProtobuf       bool
+	PreferOpenMetrics    bool
+	OmitTimestamps       bool
+	TargetMetrics        bool
+	ConflictPolicy       ConflictPolicy
+	DuplicatePolicy      DuplicatePolicy
+	MetricRelabelConfigs []RelabelConfig
+	MetricFilter         MetricFilter
 }
 
 type PromTarget struct {
-	Name        string
-	Url         string
-	ExtraLabels []string
+	Name         string
+	Url          string
+	ExtraLabels  []string
+	ScrapePolicy ScrapePolicy
+	// MetricRelabelConfigs rewrite or drop samples of the target before they are merged, extra labels included
+	MetricRelabelConfigs []RelabelConfig
+	// MetricFilter selects families of the target by name, filtered samples are skipped while parsing
+	MetricFilter MetricFilter
+	// HonorLabels keeps scraped label values colliding with ExtraLabels, otherwise the scraped labels
+	// are renamed to exported_<name> as with Prometheus honor_labels
+	HonorLabels bool
+}
+
+// relabelConfigs returns the target configs followed by the global ones
+func (pd *PromData) relabelConfigs(target PromTarget) []RelabelConfig {
+	if len(pd.MetricRelabelConfigs) == 0 {
+		return target.MetricRelabelConfigs
+	}
+	return append(target.MetricRelabelConfigs[:len(target.MetricRelabelConfigs):len(target.MetricRelabelConfigs)], pd.MetricRelabelConfigs...)
+}
+
+// ScrapePolicy controls timeout and retries of a single target, the zero value does one attempt
+// limited only by the http.Client timeout
+type ScrapePolicy struct {
+	// Timeout limits each attempt
+	Timeout time.Duration
+	// MaxRetries is the number of attempts made after the first failed one
+	MaxRetries int
+	// RetryBackoff is the pause before the first retry, doubled for every next retry
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the pause between retries, DefaultMaxRetryBackoff is used if zero
+	MaxRetryBackoff time.Duration
+	// RetryStatusCodes lists response codes worth retrying, DefaultRetryStatusCodes are used if nil
+	RetryStatusCodes []int
+	// RetryableError reports whether a request error is worth retrying, every error is retried if nil
+	RetryableError func(err error) bool
+}
+
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+func (sp ScrapePolicy) retryable(statusCode int, err error) bool {
+	if statusCode > 299 {
+		codes := sp.RetryStatusCodes
+		if codes == nil {
+			codes = DefaultRetryStatusCodes
+		}
+		return slices.Contains(codes, statusCode)
+	}
+	if sp.RetryableError != nil {
+		return sp.RetryableError(err)
+	}
+	return true
+}
+
+func (sp ScrapePolicy) backoff(attempt int) time.Duration {
+	limit := sp.MaxRetryBackoff
+	if limit <= 0 {
+		limit = DefaultMaxRetryBackoff
+	}
+	d := sp.RetryBackoff
+	for i := 0; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
 }
 
 // CollectTargets fetches metrics from multiple URLs concurrently and combines them
 func (pd *PromData) CollectTargets() error {
-	err := pd.AsyncHTTP()
-	if err != nil {
+	return pd.CollectTargetsContext(context.Background())
+}
+
+// CollectTargetsContext is like CollectTargets but stops fetching and merging once ctx is done.
+// On cancellation the metrics merged so far are kept and the context error is returned.
+func (pd *PromData) CollectTargetsContext(ctx context.Context) error {
+	return pd.completeCollect(ctx, pd.AsyncHTTPContext(ctx))
+}
+
+// completeCollect adds target metrics to the merged families and sorts them, err is the merge outcome
+func (pd *PromData) completeCollect(ctx context.Context, err error) error {
+	if pd.TargetMetrics {
+		pd.mergeFamilies(pd.BuildTargetMetrics())
+		if mergeErr := pd.finishMerge(); mergeErr != nil && err == nil {
+			err = mergeErr
+		}
+	}
+	var conflictErr *ConflictError
+	var duplicateErr *DuplicateSeriesError
+	if err != nil && ctx.Err() == nil && !errors.As(err, &conflictErr) && !errors.As(err, &duplicateErr) {
 		return err
 	}
 	if pd.Sort {
-		if pd.OmitMeta {
-			slog.Debug("Meta collecting is disabled, sort may not work")
-		}
 		t := time.Now()
-		pd.sortPromMetrics()
+		pd.sortFamilies()
 		pd.SortDuration = time.Since(t)
 		slog.Debug("Metrics sorted", slog.String("duration", pd.SortDuration.String()))
 	}
-	return nil
-}
-
-func (pd *PromData) sortPromMetrics() {
-	sort.Slice(pd.PromMetrics, func(i, j int) bool {
-		return pd.PromMetrics[i].sort < pd.PromMetrics[j].sort
-		//return pd.PromMetrics[i].Name < pd.PromMetrics[j].Name
-	})
+	return err
 }
 
 // httpClient is a shared http.Client with a custom Transport
@@ -121,14 +273,41 @@ var httpClient = &http.Client{
 */
 
 type PromChanData struct {
-	Data        string
-	Source      string
-	ExtraLabels []string
+	Data           string
+	Source         string
+	ContentType    string
+	ExtraLabels    []string
+	RelabelConfigs []RelabelConfig
+	MetricFilter   MetricFilter
+	HonorLabels    bool
+	Err            error
+	Result         *TargetResult
+}
+
+// TargetResult describes how a single target was scraped during the last collection,
+// results are ordered the same way as PromTargets
+type TargetResult struct {
+	Name        string
+	Url         string
+	StatusCode  int
+	BytesRead   int
+	Samples     int
+	ParseErrors int
+	Duration    time.Duration
 	Err         error
+	// index is the position of the target in PromTargets
+	index int
+}
+
+// target names the target in conflict and duplicate reports, the URL is used for unnamed targets
+func (res TargetResult) target() string {
+	if res.Name != "" {
+		return res.Name
+	}
+	return res.Url
 }
 
 func (pd *PromData) ToString() string {
-	var prevMetric string
 	var buffer bytes.Buffer
 
 	tP := time.Now()
@@ -150,18 +329,19 @@ func (pd *PromData) ToString() string {
 	slog.Debug("Output is prepared", slog.String("duration", pd.OutputPrepareDuration.String()))
 
 	t := time.Now()
-	for n, _ := range pd.PromMetrics {
+	for _, f := range pd.MetricFamilies {
 		// Process metadata
-		if prevMetric != pd.PromMetrics[n].Name && (pd.PromMetrics[n].Help != "" || pd.PromMetrics[n].Type != "") {
-			buffer.WriteString(pd.PromMetrics[n].Help)
-			buffer.WriteString("\n")
-			buffer.WriteString(pd.PromMetrics[n].Type)
-			buffer.WriteString("\n")
+		if f.Help != "" && !pd.OmitMeta {
+			buffer.WriteString(fmt.Sprintf("# HELP %v %v\n", f.Name, helpEscaper.Replace(f.Help)))
+		}
+		if f.Type.classic() && !pd.OmitMeta {
+			buffer.WriteString(fmt.Sprintf("# TYPE %v %v\n", f.Name, f.Type))
+		}
+		for _, p := range f.Metrics {
+			tB := time.Now()
+			buffer.WriteString(p.Output)
+			slog.Debug("Processed output string", slog.String("duration", time.Since(tB).String()))
 		}
-		tB := time.Now()
-		buffer.WriteString(pd.PromMetrics[n].Output)
-		slog.Debug("Processed output string", slog.String("duration", time.Since(tB).String()))
-		prevMetric = pd.PromMetrics[n].Name
 	}
 	pd.OutputProcessDuration = time.Since(t)
 	slog.Debug("Output processed", slog.Int("lines", len(pd.PromMetrics)), slog.String("duration", pd.OutputProcessDuration.String()))
@@ -176,22 +356,119 @@ func (pd *PromData) ToString() string {
 	return buffer.String()
 }
 
-func (pd *PromData) BuildMetricString(n int) string {
-	mStr := fmt.Sprintf("%v%v %v\n", pd.PromMetrics[n].Name, func() string {
-		if len(pd.PromMetrics[n].LabelList) == 0 {
-			return ""
+// writerPool keeps buffered writers of WriteTo for later calls, it is shared by every PromData
+var writerPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, 64*1024)
+	},
+}
+
+// WriteTo streams the merged metrics in the text format to w through a pooled buffer. Unlike ToString
+// it renders samples one by one, so the payload is never held in memory as a whole.
+func (pd *PromData) WriteTo(w io.Writer) (int64, error) {
+	t := time.Now()
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+
+	var n int64
+	var line []byte
+	write := func() error {
+		written, err := bw.Write(line)
+		n += int64(written)
+		return err
+	}
+	for _, f := range pd.MetricFamilies {
+		if f.Help != "" && !pd.OmitMeta {
+			line = fmt.Appendf(line[:0], "# HELP %v %v\n", f.Name, helpEscaper.Replace(f.Help))
+			if err := write(); err != nil {
+				return n, err
+			}
 		}
-		var labelPairs string
-		labelPairs = "{"
-		for i := 0; i < len(pd.PromMetrics[n].LabelList); i += 2 {
-			labelPairs = labelPairs + pd.PromMetrics[n].LabelList[i] + `="` + pd.PromMetrics[n].LabelList[i+1] + `"`
-			if i != len(pd.PromMetrics[n].LabelList)-2 {
-				labelPairs = labelPairs + ","
+		if f.Type.classic() && !pd.OmitMeta {
+			line = fmt.Appendf(line[:0], "# TYPE %v %v\n", f.Name, f.Type)
+			if err := write(); err != nil {
+				return n, err
 			}
 		}
-		labelPairs = labelPairs + "}"
-		return labelPairs
-	}(), pd.PromMetrics[n].Value)
+		for _, p := range f.Metrics {
+			if p.NativeHistogram != nil {
+				// Native histograms have no text representation
+				continue
+			}
+			line = pd.appendSample(line[:0], p)
+			if err := write(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return n, err
+	}
+	pd.OutputProcessDuration = time.Since(t)
+	slog.Debug("Output written", slog.Int("bytes", int(n)), slog.String("duration", pd.OutputProcessDuration.String()))
+	return n, nil
+}
+
+// appendSample renders a sample line of the text format into buf
+func (pd *PromData) appendSample(buf []byte, p *PromMetric) []byte {
+	buf = append(buf, p.Name...)
+	buf = appendLabels(buf, p.LabelList)
+	buf = append(buf, ' ')
+	buf = append(buf, FormatValue(p.Value)...)
+	if p.HasTimestamp && !pd.OmitTimestamps {
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, p.Timestamp, 10)
+	}
+	return append(buf, '\n')
+}
+
+// appendLabels renders a label list into buf the way FormatLabels does
+func appendLabels(buf []byte, labelList []string) []byte {
+	if len(labelList) == 0 {
+		return buf
+	}
+	buf = append(buf, '{')
+	for i := 0; i+1 < len(labelList); i += 2 {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, labelList[i]...)
+		buf = append(buf, `="`...)
+		buf = append(buf, labelValueEscaper.Replace(labelList[i+1])...)
+		buf = append(buf, '"')
+	}
+	return append(buf, '}')
+}
 
-	return mStr
+func (pd *PromData) BuildMetricString(n int) string {
+	if pd.PromMetrics[n].NativeHistogram != nil {
+		// Native histograms have no text representation
+		return ""
+	}
+	labels := FormatLabels(pd.PromMetrics[n].LabelList)
+	if pd.PromMetrics[n].HasTimestamp && !pd.OmitTimestamps {
+		return fmt.Sprintf("%v%v %v %v\n", pd.PromMetrics[n].Name, labels, FormatValue(pd.PromMetrics[n].Value), pd.PromMetrics[n].Timestamp)
+	}
+	return fmt.Sprintf("%v%v %v\n", pd.PromMetrics[n].Name, labels, FormatValue(pd.PromMetrics[n].Value))
+}
+
+// FormatLabels renders a label list as an escaped `{name="value",...}` label set, empty for no labels
+func FormatLabels(labelList []string) string {
+	if len(labelList) == 0 {
+		return ""
+	}
+	var labelPairs string
+	labelPairs = "{"
+	for i := 0; i < len(labelList); i += 2 {
+		labelPairs = labelPairs + labelList[i] + `="` + labelValueEscaper.Replace(labelList[i+1]) + `"`
+		if i != len(labelList)-2 {
+			labelPairs = labelPairs + ","
+		}
+	}
+	labelPairs = labelPairs + "}"
+	return labelPairs
 }
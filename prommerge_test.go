@@ -1,12 +1,17 @@
 package prommerge
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,14 +24,14 @@ func BenchmarkSortEnabled(b *testing.B) {
 		// call the function you want to test
 		pd := NewPromData([]PromTarget{
 			{
-				Url: "http://127.1:11112/metrics",
+				Url: "http://127.0.0.1:11112/metrics",
 				ExtraLabels: []string{
 					`app="api"`,
 					`source="internet"`,
 				},
 			},
 			{
-				Url: "http://127.1:11113/metrics",
+				Url: "http://127.0.0.1:11113/metrics",
 				ExtraLabels: []string{
 					`app="web"`,
 				},
@@ -54,14 +59,14 @@ func BenchmarkSortDisabled(b *testing.B) {
 		// call the function you want to test
 		pd := NewPromData([]PromTarget{
 			{
-				Url: "http://127.1:11112/metrics",
+				Url: "http://127.0.0.1:11112/metrics",
 				ExtraLabels: []string{
 					`app="api"`,
 					`source="internet"`,
 				},
 			},
 			{
-				Url: "http://127.1:11113/metrics",
+				Url: "http://127.0.0.1:11113/metrics",
 				ExtraLabels: []string{
 					`app="web"`,
 				},
@@ -90,14 +95,14 @@ func BenchmarkMetaEnabled(b *testing.B) {
 		// call the function you want to test
 		pd := NewPromData([]PromTarget{
 			{
-				Url: "http://127.1:11112/metrics",
+				Url: "http://127.0.0.1:11112/metrics",
 				ExtraLabels: []string{
 					`app="api"`,
 					`source="internet"`,
 				},
 			},
 			{
-				Url: "http://127.1:11113/metrics",
+				Url: "http://127.0.0.1:11113/metrics",
 				ExtraLabels: []string{
 					`app="web"`,
 				},
@@ -126,14 +131,14 @@ func BenchmarkMetaDisabled(b *testing.B) {
 		// call the function you want to test
 		pd := NewPromData([]PromTarget{
 			{
-				Url: "http://127.1:11112/metrics",
+				Url: "http://127.0.0.1:11112/metrics",
 				ExtraLabels: []string{
 					`app="api"`,
 					`source="internet"`,
 				},
 			},
 			{
-				Url: "http://127.1:11113/metrics",
+				Url: "http://127.0.0.1:11113/metrics",
 				ExtraLabels: []string{
 					`app="web"`,
 				},
@@ -159,7 +164,7 @@ func Benchmark100Targets(b *testing.B) {
 	for i := 0; i < 1000; i++ {
 		go http.ListenAndServe(fmt.Sprintf(":%v", basePort+i), promhttp.Handler())
 		targets = append(targets, PromTarget{
-			Url: fmt.Sprintf("http://127.1:%v/metrics", basePort+i),
+			Url: fmt.Sprintf("http://127.0.0.1:%v/metrics", basePort+i),
 			ExtraLabels: []string{
 				fmt.Sprintf(`app="api%v"`, i),
 				`source="internet"`,
@@ -193,14 +198,14 @@ func BenchmarkFunction(b *testing.B) {
 		// call the function you want to test
 		pd := NewPromData([]PromTarget{
 			{
-				Url: "http://127.1:11112/metrics",
+				Url: "http://127.0.0.1:11112/metrics",
 				ExtraLabels: []string{
 					`app="api"`,
 					`source="internet"`,
 				},
 			},
 			{
-				Url: "http://127.1:11113/metrics",
+				Url: "http://127.0.0.1:11113/metrics",
 				ExtraLabels: []string{
 					`app="web"`,
 				},
@@ -230,7 +235,7 @@ func TestMerge(t *testing.T) {
 
 	pd := NewPromData([]PromTarget{
 		{
-			Url: "http://127.1:11112/metrics",
+			Url: "http://127.0.0.1:11112/metrics",
 			ExtraLabels: []string{
 				`app="api"`,
 				`source="internet"`,
@@ -238,7 +243,7 @@ func TestMerge(t *testing.T) {
 			},
 		},
 		{
-			Url: "http://127.1:11113/metrics",
+			Url: "http://127.0.0.1:11113/metrics",
 			ExtraLabels: []string{
 				`app="web"`,
 			},
@@ -272,3 +277,613 @@ func TestMerge(t *testing.T) {
 		t.Errorf("Receive %v; want %v", result, expectedList[1])
 	}
 }
+
+func TestCollectTargetsContextCanceled(t *testing.T) {
+	fast := httptest.NewServer(promhttp.Handler())
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	pd := NewPromData([]PromTarget{
+		{Url: fast.URL, ExtraLabels: []string{`app="fast"`}},
+		{Url: slow.URL, ExtraLabels: []string{`app="slow"`}},
+	}, PromDataOpts{Async: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	err := pd.CollectTargetsContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Receive %v; want %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(pd.ToString(), `go_threads{app="fast"}`) {
+		t.Errorf("Metrics merged before cancellation are lost")
+	}
+}
+
+func TestScrapePolicyRetry(t *testing.T) {
+	var requests atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		promhttp.Handler().ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	pd := NewPromData([]PromTarget{
+		{
+			Url:         flaky.URL,
+			ExtraLabels: []string{`app="flaky"`},
+			ScrapePolicy: ScrapePolicy{
+				MaxRetries:   2,
+				RetryBackoff: time.Millisecond,
+			},
+		},
+	}, PromDataOpts{EmptyOnFailure: true})
+
+	err := pd.CollectTargets()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if requests.Load() != 3 {
+		t.Errorf("Receive %v requests; want 3", requests.Load())
+	}
+	if !strings.Contains(pd.ToString(), `go_threads{app="flaky"}`) {
+		t.Errorf("Metrics of the retried target are lost")
+	}
+}
+
+func TestScrapePolicyTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	pd := NewPromData([]PromTarget{
+		{Url: slow.URL, ScrapePolicy: ScrapePolicy{Timeout: time.Millisecond * 50}},
+	}, PromDataOpts{EmptyOnFailure: true, SupressErrors: true})
+
+	t0 := time.Now()
+	err := pd.CollectTargets()
+	if err == nil {
+		t.Fatalf("Receive nil; want timeout error")
+	}
+	if time.Since(t0) > time.Millisecond*500 {
+		t.Errorf("Target timeout is not applied, took %v", time.Since(t0))
+	}
+}
+
+func TestScrapePolicyRetryableError(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	var retried atomic.Int32
+	pd := NewPromData([]PromTarget{
+		{
+			Url: slow.URL,
+			ScrapePolicy: ScrapePolicy{
+				Timeout:      time.Millisecond * 20,
+				MaxRetries:   1,
+				RetryBackoff: time.Millisecond,
+				RetryableError: func(err error) bool {
+					if errors.Is(err, context.DeadlineExceeded) {
+						retried.Add(1)
+					}
+					return true
+				},
+			},
+		},
+	}, PromDataOpts{EmptyOnFailure: true, SupressErrors: true})
+
+	err := pd.CollectTargets()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Receive %v; want context.DeadlineExceeded", err)
+	}
+	if retried.Load() != 1 {
+		t.Errorf("RetryableError matched %v timeouts; want 1", retried.Load())
+	}
+}
+
+func TestScrapePolicyBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		policy  ScrapePolicy
+		attempt int
+		want    time.Duration
+	}{
+		{ScrapePolicy{RetryBackoff: time.Second}, 0, time.Second},
+		{ScrapePolicy{RetryBackoff: time.Second}, 3, 8 * time.Second},
+		{ScrapePolicy{RetryBackoff: time.Second}, 100, DefaultMaxRetryBackoff},
+		{ScrapePolicy{RetryBackoff: time.Second, MaxRetryBackoff: 5 * time.Second}, 100, 5 * time.Second},
+	} {
+		if got := tc.policy.backoff(tc.attempt); got != tc.want {
+			t.Errorf("Receive %v for attempt %v of %+v; want %v", got, tc.attempt, tc.policy, tc.want)
+		}
+	}
+}
+
+func TestTargetResults(t *testing.T) {
+	good := httptest.NewServer(promhttp.Handler())
+	defer good.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	pd := NewPromData([]PromTarget{
+		{Name: "good", Url: good.URL},
+		{Name: "broken", Url: broken.URL},
+	}, PromDataOpts{Async: true, SupressErrors: true})
+	err := pd.CollectTargets()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if len(pd.TargetResults) != 2 {
+		t.Fatalf("Receive %v results; want 2", len(pd.TargetResults))
+	}
+
+	res := pd.TargetResults[0]
+	if res.Name != "good" || res.StatusCode != http.StatusOK || res.Err != nil {
+		t.Errorf("Unexpected result for good target %+v", res)
+	}
+	if res.BytesRead == 0 || res.Samples == 0 || res.Samples != len(pd.PromMetrics) || res.Duration == 0 {
+		t.Errorf("Unexpected scrape stats for good target %+v", res)
+	}
+
+	res = pd.TargetResults[1]
+	if res.Name != "broken" || res.StatusCode != http.StatusInternalServerError || res.Err == nil || res.Samples != 0 {
+		t.Errorf("Unexpected result for broken target %+v", res)
+	}
+}
+
+func TestTargetMetrics(t *testing.T) {
+	good := httptest.NewServer(promhttp.Handler())
+	defer good.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	pd := NewPromData([]PromTarget{
+		{Url: good.URL, ExtraLabels: []string{`app="good"`}},
+		{Name: "broken", Url: broken.URL, ExtraLabels: []string{`app="broken"`}},
+		{Url: broken.URL, ExtraLabels: []string{`app="broken"`, `instance="db-1"`}},
+	}, PromDataOpts{Async: true, Sort: true, SupressErrors: true, TargetMetrics: true})
+	err := pd.CollectTargets()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	result := pd.ToString()
+
+	host := good.Listener.Addr().String()
+	expectedList := []string{
+		"# TYPE up gauge\n",
+		fmt.Sprintf(`up{app="good",instance="%v"} 1`, host) + "\n",
+		`up{app="broken",instance="broken"} 0` + "\n",
+		`up{app="broken",instance="db-1"} 0` + "\n",
+		fmt.Sprintf(`scrape_duration_seconds{app="good",instance="%v"}`, host),
+		fmt.Sprintf(`scrape_samples_scraped{app="good",instance="%v"} %v`, host, pd.TargetResults[0].Samples) + "\n",
+		`scrape_samples_scraped{app="broken",instance="broken"} 0` + "\n",
+	}
+	for _, expected := range expectedList {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Receive %v; want %v", result, expected)
+		}
+	}
+	if strings.Count(result, "# TYPE up gauge") != 1 {
+		t.Errorf("Metadata of up is repeated")
+	}
+}
+
+func TestMetricParserQuotedLabels(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{})
+	input := `http_requests_total{path="/a,b",agent="Mozilla/5.0 (X11, \"Linux\")",dir="C:\\tmp",msg="line1\nline2",empty=""} 7`
+	p, err := pd.MetricParser(input, []string{`app="api"`})
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	expectedLabels := []string{
+		"app", "api",
+		"path", "/a,b",
+		"agent", `Mozilla/5.0 (X11, "Linux")`,
+		"dir", `C:\tmp`,
+		"msg", "line1\nline2",
+		"empty", "",
+	}
+	if fmt.Sprint(p.LabelList) != fmt.Sprint(expectedLabels) {
+		t.Errorf("Receive %q; want %q", p.LabelList, expectedLabels)
+	}
+	if p.Value != 7 {
+		t.Errorf("Receive %v; want 7", p.Value)
+	}
+
+	pd.PromMetrics = []*PromMetric{p}
+	expected := `http_requests_total{app="api",path="/a,b",agent="Mozilla/5.0 (X11, \"Linux\")",dir="C:\\tmp",msg="line1\nline2",empty=""} 7` + "\n"
+	if output := pd.BuildMetricString(0); output != expected {
+		t.Errorf("Receive %v; want %v", output, expected)
+	}
+
+	for _, input := range []string{
+		`m{path="/a} 1`,
+		`m{path="\x"} 1`,
+		`m{path=a} 1`,
+		`m{path="a" code="200"} 1`,
+	} {
+		if _, err := pd.MetricParser(input, nil); err == nil {
+			t.Errorf("Receive nil error for %v", input)
+		}
+	}
+}
+
+func TestMetricParserTimestamp(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{})
+	p, err := pd.MetricParser(`batch_job_last_success{job="backup"} 1 1712345678901`, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if p.Timestamp != 1712345678901 {
+		t.Errorf("Receive %v; want 1712345678901", p.Timestamp)
+	}
+	pd.PromMetrics = []*PromMetric{p}
+	expected := `batch_job_last_success{job="backup"} 1 1712345678901` + "\n"
+	if output := pd.BuildMetricString(0); output != expected {
+		t.Errorf("Receive %v; want %v", output, expected)
+	}
+
+	pd.OmitTimestamps = true
+	expected = `batch_job_last_success{job="backup"} 1` + "\n"
+	if output := pd.BuildMetricString(0); output != expected {
+		t.Errorf("Receive %v; want %v", output, expected)
+	}
+
+	if _, err := pd.MetricParser(`batch_job_last_success 1 12.5`, nil); err == nil {
+		t.Errorf("Receive nil error for a non integer timestamp")
+	}
+
+	// A zero timestamp is kept, it is not the same as no timestamp
+	pd.OmitTimestamps = false
+	for _, input := range []string{"m 1 0", "m 1"} {
+		p, err := pd.MetricParser(input, nil)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		pd.PromMetrics = []*PromMetric{p}
+		if output := pd.BuildMetricString(0); output != input+"\n" {
+			t.Errorf("Receive %v; want %v", output, input)
+		}
+	}
+}
+
+func TestMetricParserSpecialValues(t *testing.T) {
+	pd := NewPromData(nil, PromDataOpts{})
+	for input, expected := range map[string]string{
+		`rpc_duration_seconds{quantile="0.5"} NaN`:       `rpc_duration_seconds{quantile="0.5"} NaN`,
+		`rpc_duration_seconds{quantile="0.9"} nan`:       `rpc_duration_seconds{quantile="0.9"} NaN`,
+		`histogram_bucket{le="+Inf"} +Inf`:               `histogram_bucket{le="+Inf"} +Inf`,
+		`temperature -Inf`:                               `temperature -Inf`,
+		`temperature Inf`:                                `temperature +Inf`,
+		`requests_total 1.5e+06`:                         `requests_total 1.5e+06`,
+		`requests_total 1E-3`:                            `requests_total 0.001`,
+		`requests_total -0.25 1712345678901`:             `requests_total -0.25 1712345678901`,
+		`requests_total{path="/"}  +12  1712345678901  `: `requests_total{path="/"} 12 1712345678901`,
+	} {
+		p, err := pd.MetricParser(input, nil)
+		if err != nil {
+			t.Errorf("Receive %v for %v; want nil", err, input)
+			continue
+		}
+		pd.PromMetrics = []*PromMetric{p}
+		if output := pd.BuildMetricString(0); output != expected+"\n" {
+			t.Errorf("Receive %v; want %v", output, expected)
+		}
+	}
+
+	for _, input := range []string{`m 0x1p-2`, `m 1_000`, `m abc`, `m`} {
+		if _, err := pd.MetricParser(input, nil); err == nil {
+			t.Errorf("Receive nil error for %v", input)
+		}
+	}
+}
+
+func TestParseMetricDataBadLines(t *testing.T) {
+	input := strings.Join([]string{
+		"# HELP good_metric A good metric.",
+		"# TYPE good_metric gauge",
+		"",
+		"# Arbitrary comment",
+		`good_metric{path="/"} 1`,
+		`bad_metric{path="/} 2`,
+		"   ",
+		`good_metric{path="/a"} 3`,
+		"#",
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{})
+	families, badLines, err := pd.parseMetricData(input, nil, nil)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if len(families) != 1 || countSamples(families) != 2 || badLines != 1 {
+		t.Errorf("Receive %v families with %v metrics and %v bad lines; want 1, 2 and 1", len(families), countSamples(families), badLines)
+	}
+
+	pd = NewPromData(nil, PromDataOpts{StrictParsing: true})
+	_, _, err = pd.parseMetricData(input, nil, nil)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Receive %v; want *ParseError", err)
+	}
+	if parseErr.Line != 6 || parseErr.Text != `bad_metric{path="/} 2` {
+		t.Errorf("Receive line %v %q; want line 6", parseErr.Line, parseErr.Text)
+	}
+}
+
+func TestParseMetricDataMetadataLines(t *testing.T) {
+	input := strings.Join([]string{
+		"# HELP job:requests:rate5m Request rate by job.",
+		"# TYPE job:requests:rate5m gauge",
+		"job:requests:rate5m 1",
+		"# HELP foo",
+		"# TYPE foo counter",
+		"foo 2",
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{StrictParsing: true})
+	families, badLines, err := pd.parseMetricData(input, nil, nil)
+	if err != nil || badLines != 0 {
+		t.Fatalf("Receive %v and %v bad lines; want nil", err, badLines)
+	}
+	if len(families) != 2 || families[0].Type != MetricTypeGauge || families[0].Help != "Request rate by job." {
+		t.Errorf("Unexpected recording rule family %+v", families[0])
+	}
+	if families[1].Type != MetricTypeCounter || families[1].Help != "" {
+		t.Errorf("Unexpected family %+v", families[1])
+	}
+}
+
+func TestParseMetricDataSamples(t *testing.T) {
+	input := strings.Join([]string{
+		`# HELP foo Foo "total".`,
+		"# TYPE foo counter",
+		`foo{a="1"} 1`,
+		`foo{a="2"} 2`,
+		"bar 3",
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{})
+	metrics := pd.ParseMetricData(input, []string{`app="x"`})
+	if len(metrics) != 3 {
+		t.Fatalf("Receive %v samples; want 3", len(metrics))
+	}
+	for _, p := range metrics[:2] {
+		if p.Help != `# HELP foo Foo "total".` || p.Type != "# TYPE foo counter" {
+			t.Errorf("Receive %q and %q; want foo metadata lines", p.Help, p.Type)
+		}
+	}
+	if metrics[2].Help != "" || metrics[2].Type != "" || strings.Join(metrics[2].LabelList, "=") != "app=x" {
+		t.Errorf("Unexpected sample %+v", metrics[2])
+	}
+
+	if !regexp.MustCompile(MetricReStr).MatchString("foo 1") || !regexp.MustCompile(HelpReStr).MatchString("# HELP foo Foo") {
+		t.Errorf("MetricReStr and HelpReStr must keep matching the classic format")
+	}
+}
+
+func TestClassicHistogramFamily(t *testing.T) {
+	input := strings.Join([]string{
+		"# HELP rpc_seconds RPC latency.",
+		"# TYPE rpc_seconds histogram",
+		`rpc_seconds_bucket{le="1"} 2`,
+		`rpc_seconds_bucket{le="+Inf"} 3`,
+		"rpc_seconds_sum 1.5",
+		"rpc_seconds_count 3",
+		"# TYPE jobs gauge",
+		"jobs 4",
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{})
+	for _, app := range []string{"a", "b"} {
+		families, _, err := pd.parseMetricData(input, []string{fmt.Sprintf(`app="%v"`, app)}, nil)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if len(families) != 2 || families[0].Type != MetricTypeHistogram || len(families[0].Metrics) != 4 {
+			t.Fatalf("Unexpected families %+v", families)
+		}
+		pd.mergeFamilies(families)
+	}
+	pd.flattenFamilies()
+
+	expected := `# HELP rpc_seconds RPC latency.
+# TYPE rpc_seconds histogram
+rpc_seconds_bucket{app="a",le="1"} 2
+rpc_seconds_bucket{app="a",le="+Inf"} 3
+rpc_seconds_sum{app="a"} 1.5
+rpc_seconds_count{app="a"} 3
+rpc_seconds_bucket{app="b",le="1"} 2
+rpc_seconds_bucket{app="b",le="+Inf"} 3
+rpc_seconds_sum{app="b"} 1.5
+rpc_seconds_count{app="b"} 3
+# TYPE jobs gauge
+jobs{app="a"} 4
+jobs{app="b"} 4
+`
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+}
+
+func TestSortHistogramFamily(t *testing.T) {
+	input := strings.Join([]string{
+		"# TYPE rpc_seconds histogram",
+		`rpc_seconds_count{path="/"} 3`,
+		`rpc_seconds_bucket{path="/",le="+Inf"} 3`,
+		`rpc_seconds_sum{path="/"} 1.5`,
+		`rpc_seconds_bucket{path="/",le="10"} 2`,
+		`rpc_seconds_bucket{path="/",le="2.5"} 1`,
+		"# TYPE rpc_quantiles summary",
+		`rpc_quantiles_sum 1`,
+		`rpc_quantiles{quantile="0.99"} 2`,
+		`rpc_quantiles{quantile="0.5"} 1`,
+	}, "\n")
+
+	pd := NewPromData(nil, PromDataOpts{Sort: true})
+	for _, app := range []string{"b", "a"} {
+		families, _, err := pd.parseMetricData(input, []string{fmt.Sprintf(`app="%v"`, app)}, nil)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		pd.mergeFamilies(families)
+	}
+	pd.sortFamilies()
+
+	expected := `# TYPE rpc_quantiles summary
+rpc_quantiles{app="a",quantile="0.5"} 1
+rpc_quantiles{app="a",quantile="0.99"} 2
+rpc_quantiles_sum{app="a"} 1
+rpc_quantiles{app="b",quantile="0.5"} 1
+rpc_quantiles{app="b",quantile="0.99"} 2
+rpc_quantiles_sum{app="b"} 1
+# TYPE rpc_seconds histogram
+rpc_seconds_bucket{app="a",path="/",le="2.5"} 1
+rpc_seconds_bucket{app="a",path="/",le="10"} 2
+rpc_seconds_bucket{app="a",path="/",le="+Inf"} 3
+rpc_seconds_sum{app="a",path="/"} 1.5
+rpc_seconds_count{app="a",path="/"} 3
+rpc_seconds_bucket{app="b",path="/",le="2.5"} 1
+rpc_seconds_bucket{app="b",path="/",le="10"} 2
+rpc_seconds_bucket{app="b",path="/",le="+Inf"} 3
+rpc_seconds_sum{app="b",path="/"} 1.5
+rpc_seconds_count{app="b",path="/"} 3
+`
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+}
+
+func TestHonorLabels(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `jobs{app="x",exported_env="old",env="dev"} 1`)
+		fmt.Fprintln(w, `queue{job="q"} 2`)
+	}))
+	defer target.Close()
+
+	for honorLabels, expected := range map[bool]string{
+		true:  `jobs{app="x",exported_env="old",env="dev"} 1` + "\n" + `queue{app="y",env="prod",job="q"} 2` + "\n",
+		false: `jobs{app="y",env="prod",exported_app="x",exported_env="old",exported_exported_env="dev"} 1` + "\n" + `queue{app="y",env="prod",job="q"} 2` + "\n",
+	} {
+		pd := NewPromData([]PromTarget{{
+			Url:         target.URL,
+			ExtraLabels: []string{"app=y", `env="prod"`},
+			HonorLabels: honorLabels,
+		}}, PromDataOpts{})
+		if err := pd.CollectTargets(); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if output := pd.ToString(); output != expected {
+			t.Errorf("Receive\n%v\nwant\n%v\nwith honor labels %v", output, expected, honorLabels)
+		}
+	}
+}
+
+func TestStrictParsingTargetResult(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "good_metric 1")
+		fmt.Fprintln(w, "bad metric line")
+	}))
+	defer bad.Close()
+
+	for _, strict := range []bool{false, true} {
+		pd := NewPromData([]PromTarget{{Url: bad.URL}}, PromDataOpts{StrictParsing: strict, SupressErrors: true})
+		err := pd.CollectTargets()
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		res := pd.TargetResults[0]
+		if res.ParseErrors != 1 {
+			t.Errorf("Receive %v parse errors; want 1", res.ParseErrors)
+		}
+		if strict && (res.Err == nil || len(pd.PromMetrics) != 0) {
+			t.Errorf("Strict parsing keeps metrics of a malformed target")
+		}
+		if !strict && (res.Err != nil || len(pd.PromMetrics) != 1) {
+			t.Errorf("Lenient parsing drops good metrics, %+v", res)
+		}
+	}
+
+	// With EmptyOnFailure a malformed target fails the collection like an unreachable one
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "good_metric 1")
+	}))
+	defer good.Close()
+	pd := NewPromData([]PromTarget{{Url: good.URL}, {Url: bad.URL}}, PromDataOpts{StrictParsing: true, EmptyOnFailure: true, SupressErrors: true})
+	err := pd.CollectTargets()
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 2 {
+		t.Errorf("Receive %v; want a parse error at line 2", err)
+	}
+	if len(pd.PromMetrics) != 0 {
+		t.Errorf("Receive %v metrics; want none", len(pd.PromMetrics))
+	}
+
+	families, badLines, err := pd.ParseMetricFamilies("good_metric 1\nbad metric line\n", nil)
+	if !errors.As(err, &parseErr) || families != nil || badLines != 0 {
+		t.Errorf("Receive %v, %v bad lines and %v; want a parse error", families, badLines, err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	target := httptest.NewServer(promhttp.Handler())
+	defer target.Close()
+
+	for _, omitMeta := range []bool{false, true} {
+		pd := NewPromData([]PromTarget{
+			{Url: target.URL, ExtraLabels: []string{`app="api"`}},
+			{Url: target.URL, ExtraLabels: []string{`app="web"`, `path="C:\dir"`}},
+		}, PromDataOpts{Sort: true, OmitMeta: omitMeta})
+		if err := pd.CollectTargets(); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		var buffer strings.Builder
+		n, err := pd.WriteTo(&buffer)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		expected := pd.ToString()
+		if buffer.String() != expected {
+			t.Errorf("Receive\n%v\nwant\n%v\nwith omit meta %v", buffer.String(), expected, omitMeta)
+		}
+		if n != int64(len(expected)) {
+			t.Errorf("Receive %v bytes; want %v", n, len(expected))
+		}
+	}
+}
+
+func TestCollectTargetsRepeated(t *testing.T) {
+	var scrapes atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE scrapes counter\nscrapes %v\n", scrapes.Add(1))
+	}))
+	defer target.Close()
+
+	pd := NewPromData([]PromTarget{{Url: target.URL}}, PromDataOpts{})
+	for i := 1; i <= 3; i++ {
+		if err := pd.CollectTargets(); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		expected := fmt.Sprintf("# TYPE scrapes counter\nscrapes %v\n", i)
+		if output := pd.ToString(); output != expected {
+			t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+		}
+	}
+}
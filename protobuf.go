@@ -0,0 +1,440 @@
+package prommerge
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"slices"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	ProtobufContentType = "application/vnd.google.protobuf"
+	ProtobufProtocol    = "io.prometheus.client.MetricFamily"
+	// ProtobufAcceptHeader prefers the delimited protobuf format and falls back to AcceptHeader
+	ProtobufAcceptHeader = protobufAccept + "," + AcceptHeader
+	protobufAccept       = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited`
+)
+
+// NativeHistogram carries a native (sparse) histogram as exposed in protobuf, it is passed through unchanged
+type NativeHistogram struct {
+	Schema         int32
+	ZeroThreshold  float64
+	ZeroCount      uint64
+	ZeroCountFloat float64
+	Count          uint64
+	CountFloat     float64
+	Sum            float64
+	NegativeSpans  []BucketSpan
+	NegativeDeltas []int64
+	NegativeCounts []float64
+	PositiveSpans  []BucketSpan
+	PositiveDeltas []int64
+	PositiveCounts []float64
+}
+
+// BucketSpan describes a run of consecutive native histogram buckets
+type BucketSpan struct {
+	Offset int32
+	Length uint32
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// IsProtobuf reports whether the Content-Type header value denotes the delimited protobuf format
+func IsProtobuf(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ProtobufContentType && params["proto"] == ProtobufProtocol && params["encoding"] == "delimited"
+}
+
+// parseProtobufData decodes delimited MetricFamily messages into families.
+// A decoding error stops parsing, the families decoded before it are kept unless StrictParsing is set.
+func (pd *PromData) parseProtobufData(in string, extraLabels []string, filter *nameFilter) ([]*MetricFamily, int, error) {
+	var families []*MetricFamily
+	// expfmt decoder wraps the reader into a new bufio.Reader on every call, so it is read directly
+	reader := strings.NewReader(in)
+	for n := 1; ; n++ {
+		mf := new(dto.MetricFamily)
+		err := protodelim.UnmarshalFrom(reader, mf)
+		if errors.Is(err, io.EOF) {
+			return families, 0, nil
+		}
+		if err != nil {
+			err = &ParseError{Line: n, Err: fmt.Errorf("error decoding metric family, %v", err)}
+			if pd.StrictParsing {
+				return nil, 1, err
+			}
+			return families, 1, nil
+		}
+		if !filter.allows(mf.GetName()) {
+			continue
+		}
+		if f := pd.MetricFamilyFromProtobuf(mf, extraLabels); len(f.Metrics) > 0 {
+			families = append(families, f)
+		}
+	}
+}
+
+// MetricFamilyFromProtobuf converts a protobuf metric family into a family of classic text format samples
+func (pd *PromData) MetricFamilyFromProtobuf(mf *dto.MetricFamily, extraLabels []string) *MetricFamily {
+	name := mf.GetName()
+	family := &MetricFamily{Name: name, Help: mf.GetHelp(), Type: MetricTypeUntyped}
+	extraLabelList := ExtraLabelList(extraLabels)
+
+	add := func(m *dto.Metric, sampleName string, value float64, labelList ...string) *PromMetric {
+		p := &PromMetric{
+			Name:         sampleName,
+			LabelList:    make([]string, 0, len(extraLabelList)+2*len(m.GetLabel())+len(labelList)),
+			Value:        value,
+			Timestamp:    m.GetTimestampMs(),
+			HasTimestamp: m.TimestampMs != nil,
+		}
+		p.LabelList = append(p.LabelList, extraLabelList...)
+		for _, l := range m.GetLabel() {
+			p.LabelList = append(p.LabelList, l.GetName(), l.GetValue())
+		}
+		p.LabelList = append(p.LabelList, labelList...)
+		family.Metrics = append(family.Metrics, p)
+		return p
+	}
+
+	for _, m := range mf.GetMetric() {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			family.Type = MetricTypeCounter
+			p := add(m, name, m.GetCounter().GetValue())
+			p.Exemplar = protobufExemplar(m.GetCounter().GetExemplar())
+			p.Created = protobufCreated(m.GetCounter().GetCreatedTimestamp())
+		case dto.MetricType_GAUGE:
+			family.Type = MetricTypeGauge
+			add(m, name, m.GetGauge().GetValue())
+		case dto.MetricType_SUMMARY:
+			family.Type = MetricTypeSummary
+			s := m.GetSummary()
+			for _, q := range s.GetQuantile() {
+				add(m, name, q.GetValue(), "quantile", FormatValue(q.GetQuantile()))
+			}
+			add(m, name+"_sum", s.GetSampleSum())
+			p := add(m, name+"_count", float64(s.GetSampleCount()))
+			p.Created = protobufCreated(s.GetCreatedTimestamp())
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			family.Type = MetricTypeHistogram
+			h := m.GetHistogram()
+			count := float64(h.GetSampleCount())
+			if h.SampleCountFloat != nil {
+				count = h.GetSampleCountFloat()
+			}
+			hasInf := false
+			for _, b := range h.GetBucket() {
+				bucketCount := float64(b.GetCumulativeCount())
+				if b.CumulativeCountFloat != nil {
+					bucketCount = b.GetCumulativeCountFloat()
+				}
+				p := add(m, name+"_bucket", bucketCount, "le", FormatValue(b.GetUpperBound()))
+				p.Exemplar = protobufExemplar(b.GetExemplar())
+				hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+			}
+			if !hasInf {
+				add(m, name+"_bucket", count, "le", "+Inf")
+			}
+			add(m, name+"_sum", h.GetSampleSum())
+			p := add(m, name+"_count", count)
+			p.Created = protobufCreated(h.GetCreatedTimestamp())
+			if isNativeHistogram(h) {
+				// The native part is kept as a separate sample, text outputs skip it
+				p := add(m, name, count)
+				p.NativeHistogram = nativeHistogram(h)
+			}
+		default:
+			add(m, name, m.GetUntyped().GetValue())
+		}
+	}
+
+	return family
+}
+
+func isNativeHistogram(h *dto.Histogram) bool {
+	return h.Schema != nil || h.GetZeroThreshold() > 0 || h.GetZeroCount() > 0 || h.GetZeroCountFloat() > 0 ||
+		len(h.GetPositiveSpan()) > 0 || len(h.GetNegativeSpan()) > 0
+}
+
+func nativeHistogram(h *dto.Histogram) *NativeHistogram {
+	spans := func(in []*dto.BucketSpan) []BucketSpan {
+		var out []BucketSpan
+		for _, span := range in {
+			out = append(out, BucketSpan{Offset: span.GetOffset(), Length: span.GetLength()})
+		}
+		return out
+	}
+	return &NativeHistogram{
+		Schema:         h.GetSchema(),
+		ZeroThreshold:  h.GetZeroThreshold(),
+		ZeroCount:      h.GetZeroCount(),
+		ZeroCountFloat: h.GetZeroCountFloat(),
+		Count:          h.GetSampleCount(),
+		CountFloat:     h.GetSampleCountFloat(),
+		Sum:            h.GetSampleSum(),
+		NegativeSpans:  spans(h.GetNegativeSpan()),
+		NegativeDeltas: h.GetNegativeDelta(),
+		NegativeCounts: h.GetNegativeCount(),
+		PositiveSpans:  spans(h.GetPositiveSpan()),
+		PositiveDeltas: h.GetPositiveDelta(),
+		PositiveCounts: h.GetPositiveCount(),
+	}
+}
+
+// setNativeHistogram writes native histogram fields into a protobuf histogram
+func setNativeHistogram(h *dto.Histogram, nh *NativeHistogram) {
+	spans := func(in []BucketSpan) []*dto.BucketSpan {
+		var out []*dto.BucketSpan
+		for _, span := range in {
+			out = append(out, &dto.BucketSpan{Offset: proto.Int32(span.Offset), Length: proto.Uint32(span.Length)})
+		}
+		return out
+	}
+	h.Schema = proto.Int32(nh.Schema)
+	h.ZeroThreshold = proto.Float64(nh.ZeroThreshold)
+	if nh.ZeroCountFloat > 0 {
+		h.ZeroCountFloat = proto.Float64(nh.ZeroCountFloat)
+	} else {
+		h.ZeroCount = proto.Uint64(nh.ZeroCount)
+	}
+	if nh.CountFloat > 0 {
+		h.SampleCountFloat = proto.Float64(nh.CountFloat)
+	} else {
+		h.SampleCount = proto.Uint64(nh.Count)
+	}
+	h.SampleSum = proto.Float64(nh.Sum)
+	h.NegativeSpan = spans(nh.NegativeSpans)
+	h.NegativeDelta = nh.NegativeDeltas
+	h.NegativeCount = nh.NegativeCounts
+	h.PositiveSpan = spans(nh.PositiveSpans)
+	h.PositiveDelta = nh.PositiveDeltas
+	h.PositiveCount = nh.PositiveCounts
+}
+
+func protobufExemplar(e *dto.Exemplar) *Exemplar {
+	if e == nil {
+		return nil
+	}
+	exemplar := &Exemplar{Value: e.GetValue()}
+	for _, l := range e.GetLabel() {
+		exemplar.LabelList = append(exemplar.LabelList, l.GetName(), l.GetValue())
+	}
+	if e.Timestamp != nil {
+		exemplar.Timestamp, exemplar.HasTimestamp = e.GetTimestamp().AsTime().UnixMilli(), true
+	}
+	return exemplar
+}
+
+func protobufCreated(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// WriteProtobuf encodes the merged metrics as delimited MetricFamily messages, one per family.
+// Histogram and summary samples are reassembled from their _bucket, _sum and _count series,
+// samples of undeclared families are encoded as untyped families of their own name.
+func (pd *PromData) WriteProtobuf(w io.Writer) error {
+	for _, f := range pd.MetricFamilies {
+		for _, mf := range pd.buildMetricFamilies(f) {
+			if len(mf.Metric) == 0 {
+				continue
+			}
+			if _, err := protodelim.MarshalTo(w, mf); err != nil {
+				return fmt.Errorf("error encoding metric family %v, %v", mf.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// buildMetricFamilies converts a family into protobuf, a family without type or a gauge histogram may hold samples of several names
+// and gets split by the sample name
+func (pd *PromData) buildMetricFamilies(f *MetricFamily) []*dto.MetricFamily {
+	if f.Type.classic() {
+		return []*dto.MetricFamily{pd.buildMetricFamily(f)}
+	}
+	var names []string
+	byName := make(map[string]*MetricFamily)
+	for _, p := range f.Metrics {
+		if byName[p.Name] == nil {
+			byName[p.Name] = &MetricFamily{Name: p.Name, Type: MetricTypeUntyped}
+			names = append(names, p.Name)
+		}
+		byName[p.Name].Metrics = append(byName[p.Name].Metrics, p)
+	}
+	if byName[f.Name] != nil {
+		byName[f.Name].Help = f.Help
+	}
+	var families []*dto.MetricFamily
+	for _, name := range names {
+		families = append(families, pd.buildMetricFamily(byName[name]))
+	}
+	return families
+}
+
+func (pd *PromData) buildMetricFamily(f *MetricFamily) *dto.MetricFamily {
+	mf := &dto.MetricFamily{Name: proto.String(f.Name)}
+	if f.Help != "" {
+		mf.Help = proto.String(f.Help)
+	}
+
+	newMetric := func(p *PromMetric, skipLabel string) *dto.Metric {
+		m := new(dto.Metric)
+		for i := 0; i+1 < len(p.LabelList); i += 2 {
+			if p.LabelList[i] == skipLabel {
+				continue
+			}
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(p.LabelList[i]), Value: proto.String(p.LabelList[i+1])})
+		}
+		if p.HasTimestamp && !pd.OmitTimestamps {
+			m.TimestampMs = proto.Int64(p.Timestamp)
+		}
+		return m
+	}
+
+	switch f.Type {
+	case MetricTypeCounter:
+		mf.Type = dto.MetricType_COUNTER.Enum()
+		for _, p := range f.Metrics {
+			m := newMetric(p, "")
+			m.Counter = &dto.Counter{Value: proto.Float64(p.Value), Exemplar: protobufExemplarFrom(p.Exemplar), CreatedTimestamp: protobufCreatedFrom(p.Created)}
+			mf.Metric = append(mf.Metric, m)
+		}
+	case MetricTypeGauge:
+		mf.Type = dto.MetricType_GAUGE.Enum()
+		for _, p := range f.Metrics {
+			m := newMetric(p, "")
+			m.Gauge = &dto.Gauge{Value: proto.Float64(p.Value)}
+			mf.Metric = append(mf.Metric, m)
+		}
+	case MetricTypeHistogram, MetricTypeSummary:
+		// Samples of one series differ only by the le or quantile label
+		series := make(map[string]*dto.Metric)
+		for _, p := range f.Metrics {
+			key := seriesKey(p.LabelList)
+			m := series[key]
+			if m == nil {
+				m = newMetric(p, map[MetricType]string{MetricTypeHistogram: "le", MetricTypeSummary: "quantile"}[f.Type])
+				if f.Type == MetricTypeHistogram {
+					m.Histogram = new(dto.Histogram)
+				} else {
+					m.Summary = new(dto.Summary)
+				}
+				series[key] = m
+				mf.Metric = append(mf.Metric, m)
+			}
+			pd.addHistogramSample(f, m, p)
+		}
+		for _, m := range mf.Metric {
+			if m.Histogram != nil && m.Histogram.Schema != nil && len(m.Histogram.Bucket) == 1 && math.IsInf(m.Histogram.Bucket[0].GetUpperBound(), 1) {
+				// The +Inf bucket was only added for the text format, a native histogram has no classic buckets
+				m.Histogram.Bucket = nil
+			}
+			if m.Histogram != nil {
+				slices.SortFunc(m.Histogram.Bucket, func(a, b *dto.Bucket) int {
+					return cmp.Compare(a.GetUpperBound(), b.GetUpperBound())
+				})
+			} else {
+				slices.SortFunc(m.Summary.Quantile, func(a, b *dto.Quantile) int {
+					return cmp.Compare(a.GetQuantile(), b.GetQuantile())
+				})
+			}
+		}
+		if f.Type == MetricTypeHistogram {
+			mf.Type = dto.MetricType_HISTOGRAM.Enum()
+		} else {
+			mf.Type = dto.MetricType_SUMMARY.Enum()
+		}
+	default:
+		mf.Type = dto.MetricType_UNTYPED.Enum()
+		for _, p := range f.Metrics {
+			m := newMetric(p, "")
+			m.Untyped = &dto.Untyped{Value: proto.Float64(p.Value)}
+			mf.Metric = append(mf.Metric, m)
+		}
+	}
+	return mf
+}
+
+// addHistogramSample puts a flat histogram or summary sample into its place in the protobuf metric
+func (pd *PromData) addHistogramSample(f *MetricFamily, m *dto.Metric, p *PromMetric) {
+	labelValue := func(name string) string {
+		for i := 0; i+1 < len(p.LabelList); i += 2 {
+			if p.LabelList[i] == name {
+				return p.LabelList[i+1]
+			}
+		}
+		return ""
+	}
+
+	switch p.Name {
+	case f.Name + "_sum":
+		if m.Histogram != nil {
+			m.Histogram.SampleSum = proto.Float64(p.Value)
+		} else {
+			m.Summary.SampleSum = proto.Float64(p.Value)
+		}
+	case f.Name + "_count":
+		if m.Histogram != nil {
+			m.Histogram.SampleCount = proto.Uint64(uint64(p.Value))
+			m.Histogram.CreatedTimestamp = protobufCreatedFrom(p.Created)
+		} else {
+			m.Summary.SampleCount = proto.Uint64(uint64(p.Value))
+			m.Summary.CreatedTimestamp = protobufCreatedFrom(p.Created)
+		}
+	case f.Name + "_bucket":
+		upperBound, err := ParseValue(labelValue("le"))
+		if err != nil || m.Histogram == nil {
+			return
+		}
+		m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(upperBound),
+			CumulativeCount: proto.Uint64(uint64(p.Value)),
+			Exemplar:        protobufExemplarFrom(p.Exemplar),
+		})
+	case f.Name:
+		if p.NativeHistogram != nil && m.Histogram != nil {
+			setNativeHistogram(m.Histogram, p.NativeHistogram)
+			return
+		}
+		quantile, err := ParseValue(labelValue("quantile"))
+		if err != nil || m.Summary == nil {
+			return
+		}
+		m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{Quantile: proto.Float64(quantile), Value: proto.Float64(p.Value)})
+	}
+}
+
+func protobufExemplarFrom(e *Exemplar) *dto.Exemplar {
+	if e == nil {
+		return nil
+	}
+	exemplar := &dto.Exemplar{Value: proto.Float64(e.Value)}
+	for i := 0; i+1 < len(e.LabelList); i += 2 {
+		exemplar.Label = append(exemplar.Label, &dto.LabelPair{Name: proto.String(e.LabelList[i]), Value: proto.String(e.LabelList[i+1])})
+	}
+	if e.HasTimestamp {
+		exemplar.Timestamp = timestamppb.New(time.UnixMilli(e.Timestamp))
+	}
+	return exemplar
+}
+
+func protobufCreatedFrom(created time.Time) *timestamppb.Timestamp {
+	if created.IsZero() {
+		return nil
+	}
+	return timestamppb.New(created)
+}
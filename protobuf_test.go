@@ -0,0 +1,172 @@
+package prommerge
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "jobs_total", Help: "Jobs done."}, []string{"queue"})
+	counter.WithLabelValues("default").Add(3)
+	counter.WithLabelValues(`a,"b"`).Add(1)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "temperature_celsius", Help: "Current temperature."})
+	gauge.Set(21.5)
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "request_duration_seconds", Help: "Request duration.", Buckets: []float64{0.1, 1}}, []string{"path"})
+	histogram.WithLabelValues("/").Observe(0.05)
+	histogram.WithLabelValues("/a").Observe(2)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "rpc_seconds", Help: "RPC latency.", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(0.3)
+	reg.MustRegister(counter, gauge, histogram, summary)
+	return reg
+}
+
+func TestCollectProtobufTarget(t *testing.T) {
+	var contentType string
+	handler := promhttp.HandlerFor(newTestRegistry(), promhttp.HandlerOpts{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		contentType = w.Header().Get("Content-Type")
+	}))
+	defer target.Close()
+
+	collect := func(preferProtobuf bool, omitMeta bool) string {
+		pd := NewPromData([]PromTarget{{Url: target.URL, ExtraLabels: []string{`app="api"`}}}, PromDataOpts{
+			Sort:           true,
+			OmitMeta:       omitMeta,
+			PreferProtobuf: preferProtobuf,
+		})
+		err := pd.CollectTargets()
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		if pd.TargetResults[0].Samples == 0 || pd.TargetResults[0].ParseErrors != 0 {
+			t.Errorf("Unexpected target result %+v", pd.TargetResults[0])
+		}
+		return pd.ToString()
+	}
+
+	text := collect(false, true)
+	protobuf := collect(true, true)
+	if !IsProtobuf(contentType) {
+		t.Fatalf("Receive content type %v; want protobuf", contentType)
+	}
+	if text != protobuf {
+		t.Errorf("Protobuf output\n%v\ndiffers from text output\n%v", protobuf, text)
+	}
+
+	result := collect(true, false)
+	expectedList := []string{
+		"# HELP request_duration_seconds Request duration.\n# TYPE request_duration_seconds histogram\n" +
+			`request_duration_seconds_bucket{app="api",path="/",le="0.1"} 1` + "\n",
+		`request_duration_seconds_bucket{app="api",path="/a",le="+Inf"} 1` + "\n" +
+			`request_duration_seconds_sum{app="api",path="/a"} 2` + "\n",
+		"# TYPE jobs_total counter\n" + `jobs_total{app="api",queue="a,\"b\""} 1` + "\n",
+		"# TYPE rpc_seconds summary\n" + `rpc_seconds{app="api",quantile="0.5"} 0.3` + "\n",
+	}
+	for _, expected := range expectedList {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Receive %v; want %v", result, expected)
+		}
+	}
+	if strings.Count(result, "# TYPE request_duration_seconds histogram") != 1 {
+		t.Errorf("Metadata of request_duration_seconds is repeated")
+	}
+}
+
+func TestWriteProtobuf(t *testing.T) {
+	target := httptest.NewServer(promhttp.HandlerFor(newTestRegistry(), promhttp.HandlerOpts{}))
+	defer target.Close()
+
+	for _, preferProtobuf := range []bool{false, true} {
+		pd := NewPromData([]PromTarget{{Url: target.URL, ExtraLabels: []string{`app="api"`}}}, PromDataOpts{
+			Sort:           true,
+			PreferProtobuf: preferProtobuf,
+		})
+		err := pd.CollectTargets()
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		var buffer bytes.Buffer
+		err = pd.WriteProtobuf(&buffer)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+
+		// Decode the output again and compare both renderings
+		decoded := NewPromData(nil, PromDataOpts{Sort: true})
+		families, _, err := decoded.parseProtobufData(buffer.String(), nil, nil)
+		if err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+		decoded.mergeFamilies(families)
+		decoded.sortFamilies()
+		if decoded.ToString() != pd.ToString() {
+			t.Errorf("Decoded protobuf output\n%v\ndiffers from\n%v", decoded.ToString(), pd.ToString())
+		}
+	}
+}
+
+func TestNativeHistogramPassThrough(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "native_duration_seconds",
+		Help:                        "Native histogram.",
+		NativeHistogramBucketFactor: 1.1,
+	})
+	for _, v := range []float64{0, 0.01, 0.5, 2, -1} {
+		histogram.Observe(v)
+	}
+	reg.MustRegister(histogram)
+	target := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer target.Close()
+
+	pd := NewPromData([]PromTarget{{Url: target.URL, ExtraLabels: []string{`app="api"`}}}, PromDataOpts{PreferProtobuf: true})
+	err := pd.CollectTargets()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+
+	text := pd.ToString()
+	if !strings.Contains(text, `native_duration_seconds_bucket{app="api",le="+Inf"} 5`) || strings.Contains(text, "native_duration_seconds{") {
+		t.Errorf("Unexpected text output %v", text)
+	}
+
+	var buffer bytes.Buffer
+	err = pd.WriteProtobuf(&buffer)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	expected, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	mf := new(dto.MetricFamily)
+	err = protodelim.UnmarshalFrom(bufio.NewReader(&buffer), mf)
+	if err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	if mf.GetType() != dto.MetricType_HISTOGRAM || len(mf.GetMetric()) != 1 {
+		t.Fatalf("Unexpected metric family %v", mf)
+	}
+	m := mf.GetMetric()[0]
+	if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetName() != "app" || m.GetLabel()[0].GetValue() != "api" {
+		t.Errorf("Receive labels %v; want app=api", m.GetLabel())
+	}
+	// Apart from the extra label the histogram must be passed through unchanged
+	m.Label = nil
+	want := expected[0].GetMetric()[0].GetHistogram()
+	if !proto.Equal(m.GetHistogram(), want) {
+		t.Errorf("Receive %v; want %v", m.GetHistogram(), want)
+	}
+}
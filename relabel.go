@@ -0,0 +1,306 @@
+package prommerge
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RelabelAction is the action of a RelabelConfig, named as in Prometheus metric_relabel_configs
+type RelabelAction string
+
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelHashMod   RelabelAction = "hashmod"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	RelabelLabelKeep RelabelAction = "labelkeep"
+	RelabelLowercase RelabelAction = "lowercase"
+	RelabelUppercase RelabelAction = "uppercase"
+)
+
+const (
+	DefaultRelabelSeparator   = ";"
+	DefaultRelabelRegex       = "(.*)"
+	DefaultRelabelReplacement = "$1"
+)
+
+// RelabelConfig is a rule of Prometheus metric_relabel_configs. The metric name is available as
+// the __name__ label. Empty Regex and Action take the Prometheus defaults, nil Separator and Replacement
+// take DefaultRelabelSeparator and DefaultRelabelReplacement, so an empty replacement removes the target label.
+type RelabelConfig struct {
+	SourceLabels []string
+	Separator    *string
+	Regex        string
+	Modulus      uint64
+	TargetLabel  string
+	Replacement  *string
+	Action       RelabelAction
+}
+
+// maxAnchoredRegexps bounds anchoredRegexps, the cache is emptied once it is full, so expressions
+// of configs replaced by reloads don't pile up
+const maxAnchoredRegexps = 1024
+
+// anchoredRegexps caches regexps of relabel configs and metric filters by their expression,
+// as they are compiled for every collection
+var anchoredRegexps = struct {
+	sync.RWMutex
+	regexps map[string]*regexp.Regexp
+}{regexps: make(map[string]*regexp.Regexp)}
+
+// anchoredRegexp compiles the expression anchored at both ends, as Prometheus does
+func anchoredRegexp(expr string) (*regexp.Regexp, error) {
+	anchoredRegexps.RLock()
+	re, ok := anchoredRegexps.regexps[expr]
+	anchoredRegexps.RUnlock()
+	if ok {
+		return re, nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %v, %v", expr, err)
+	}
+	anchoredRegexps.Lock()
+	defer anchoredRegexps.Unlock()
+	if len(anchoredRegexps.regexps) >= maxAnchoredRegexps {
+		clear(anchoredRegexps.regexps)
+	}
+	anchoredRegexps.regexps[expr] = re
+	return re, nil
+}
+
+func relabelRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		expr = DefaultRelabelRegex
+	}
+	return anchoredRegexp(expr)
+}
+
+// Validate checks the action, regex and the fields the action requires
+func (rc RelabelConfig) Validate() error {
+	if _, err := relabelRegexp(rc.Regex); err != nil {
+		return err
+	}
+	switch rc.action() {
+	case RelabelReplace, RelabelLowercase, RelabelUppercase:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("relabel action %v requires target label", rc.action())
+		}
+	case RelabelHashMod:
+		if rc.TargetLabel == "" || rc.Modulus == 0 {
+			return fmt.Errorf("relabel action %v requires target label and modulus", rc.action())
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown relabel action %v", rc.Action)
+	}
+	return nil
+}
+
+func (rc RelabelConfig) action() RelabelAction {
+	if rc.Action == "" {
+		return RelabelReplace
+	}
+	return rc.Action
+}
+
+func (rc RelabelConfig) separator() string {
+	if rc.Separator == nil {
+		return DefaultRelabelSeparator
+	}
+	return *rc.Separator
+}
+
+func (rc RelabelConfig) replacement() string {
+	if rc.Replacement == nil {
+		return DefaultRelabelReplacement
+	}
+	return *rc.Replacement
+}
+
+// relabelRegexps compiles the regexps of the configs, the regexp of an invalid config is nil
+func relabelRegexps(configs []RelabelConfig) []*regexp.Regexp {
+	regexps := make([]*regexp.Regexp, len(configs))
+	for i, rc := range configs {
+		regexps[i], _ = relabelRegexp(rc.Regex)
+	}
+	return regexps
+}
+
+// Relabel applies the configs in order to the sample name and label list,
+// keep is false if the sample is dropped
+func Relabel(name string, labelList []string, configs []RelabelConfig) (string, []string, bool) {
+	return relabel(name, labelList, configs, relabelRegexps(configs))
+}
+
+// relabel is Relabel with the regexps of the configs compiled by relabelRegexps
+func relabel(name string, labelList []string, configs []RelabelConfig, regexps []*regexp.Regexp) (string, []string, bool) {
+	labels := make([]string, 0, len(labelList)+2)
+	labels = append(labels, "__name__", name)
+	labels = append(labels, labelList...)
+	for i, rc := range configs {
+		if regexps[i] == nil {
+			// Configs are validated before collecting, an invalid one is ignored
+			continue
+		}
+		var keep bool
+		labels, keep = rc.apply(regexps[i], labels)
+		if !keep {
+			return "", nil, false
+		}
+	}
+	name = labelValue(labels, "__name__")
+	if name == "" {
+		return "", nil, false
+	}
+	return name, deleteLabel(labels, "__name__"), true
+}
+
+// apply runs a single rule with its compiled regexp on a label list holding __name__
+func (rc RelabelConfig) apply(re *regexp.Regexp, labels []string) ([]string, bool) {
+	separator, replacement := rc.separator(), rc.replacement()
+	values := make([]string, 0, len(rc.SourceLabels))
+	for _, name := range rc.SourceLabels {
+		values = append(values, labelValue(labels, name))
+	}
+	value := strings.Join(values, separator)
+
+	switch rc.action() {
+	case RelabelKeep:
+		return labels, re.MatchString(value)
+	case RelabelDrop:
+		return labels, !re.MatchString(value)
+	case RelabelReplace:
+		match := re.FindStringSubmatchIndex(value)
+		if match == nil {
+			return labels, true
+		}
+		target := string(re.ExpandString(nil, rc.TargetLabel, value, match))
+		if !isLabelName(target) {
+			return labels, true
+		}
+		result := string(re.ExpandString(nil, replacement, value, match))
+		if result == "" {
+			return deleteLabel(labels, target), true
+		}
+		return setLabel(labels, target, result), true
+	case RelabelLowercase:
+		return setLabel(labels, rc.TargetLabel, strings.ToLower(value)), true
+	case RelabelUppercase:
+		return setLabel(labels, rc.TargetLabel, strings.ToUpper(value)), true
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(value))
+		return setLabel(labels, rc.TargetLabel, fmt.Sprint(binary.BigEndian.Uint64(sum[8:])%rc.Modulus)), true
+	case RelabelLabelMap:
+		result := labels
+		for i := 0; i+1 < len(labels); i += 2 {
+			if match := re.FindStringSubmatchIndex(labels[i]); match != nil {
+				result = setLabel(result, string(re.ExpandString(nil, replacement, labels[i], match)), labels[i+1])
+			}
+		}
+		return result, true
+	case RelabelLabelDrop, RelabelLabelKeep:
+		drop := rc.action() == RelabelLabelDrop
+		result := labels[:0:0]
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i] == "__name__" || re.MatchString(labels[i]) != drop {
+				result = append(result, labels[i], labels[i+1])
+			}
+		}
+		return result, true
+	}
+	return labels, true
+}
+
+// labelValue returns the value of the label, empty if it is missing
+func labelValue(labelList []string, name string) string {
+	for i := 0; i+1 < len(labelList); i += 2 {
+		if labelList[i] == name {
+			return labelList[i+1]
+		}
+	}
+	return ""
+}
+
+// setLabel replaces the value of the label or appends the label, the input list is not modified
+func setLabel(labelList []string, name, value string) []string {
+	result := append(labelList[:0:0], labelList...)
+	for i := 0; i+1 < len(result); i += 2 {
+		if result[i] == name {
+			result[i+1] = value
+			return result
+		}
+	}
+	return append(result, name, value)
+}
+
+// deleteLabel removes the label, the input list is not modified
+func deleteLabel(labelList []string, name string) []string {
+	result := make([]string, 0, len(labelList))
+	for i := 0; i+1 < len(labelList); i += 2 {
+		if labelList[i] != name {
+			result = append(result, labelList[i], labelList[i+1])
+		}
+	}
+	return result
+}
+
+func isLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isLabelNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// relabelFamilies applies the configs to every sample of the families. A renamed sample moves to the family
+// named after it, the family metadata follows if the sample keeps its suffix, as _bucket of a histogram does.
+func (pd *PromData) relabelFamilies(families []*MetricFamily, configs []RelabelConfig) []*MetricFamily {
+	if len(configs) == 0 {
+		return families
+	}
+	regexps := relabelRegexps(configs)
+	builder := newFamilyBuilder()
+	for _, f := range families {
+		for _, p := range f.Metrics {
+			name, labelList, keep := relabel(p.Name, p.LabelList, configs, regexps)
+			if !keep {
+				continue
+			}
+			familyName, inherit := f.Name, true
+			if name != p.Name {
+				familyName, inherit = name, false
+				if suffix, ok := strings.CutPrefix(p.Name, f.Name); ok {
+					if base, found := strings.CutSuffix(name, suffix); found && base != "" {
+						familyName, inherit = base, true
+					}
+				}
+			}
+			target := builder.family(familyName)
+			if inherit {
+				if target.Help == "" {
+					target.Help = f.Help
+				}
+				if target.Type == MetricTypeUnknown {
+					target.Type = f.Type
+				}
+				if target.Unit == "" {
+					target.Unit = f.Unit
+				}
+			}
+			p.Name, p.LabelList = name, labelList
+			target.Metrics = append(target.Metrics, p)
+		}
+	}
+	return builder.result()
+}
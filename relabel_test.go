@@ -0,0 +1,162 @@
+package prommerge
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRelabel(t *testing.T) {
+	labelList := []string{"app", "api", "Path", "/Users/42", "instance", "10.0.0.1:9100", "__meta_zone", "eu"}
+	for _, test := range []struct {
+		configs  []RelabelConfig
+		expected string
+	}{
+		{
+			[]RelabelConfig{{SourceLabels: []string{"instance"}, Regex: `(.*):\d+`, TargetLabel: "host"}},
+			`http_requests_total{app="api",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu",host="10.0.0.1"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app", "__meta_zone"}, TargetLabel: "app", Replacement: relabelString("${1}-x")}},
+			`http_requests_total{app="api;eu-x",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "http_(.*)", TargetLabel: "__name__", Replacement: relabelString("web_$1")}},
+			`web_requests_total{app="api",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app", "__meta_zone"}, Separator: relabelString(""), TargetLabel: "app"}},
+			`http_requests_total{app="apieu",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app"}, TargetLabel: "instance", Replacement: relabelString("")}},
+			`http_requests_total{app="api",Path="/Users/42",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app"}, Regex: "api|web", Action: RelabelKeep}},
+			`http_requests_total{app="api",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app"}, Regex: "ap", Action: RelabelKeep}},
+			"dropped",
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"__name__"}, Regex: "http_.*", Action: RelabelDrop}},
+			"dropped",
+		},
+		{
+			[]RelabelConfig{{Regex: "__meta_(.*)", Action: RelabelLabelMap}},
+			`http_requests_total{app="api",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu",zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{Regex: "instance|__meta_.*", Action: RelabelLabelDrop}},
+			`http_requests_total{app="api",Path="/Users/42"}`,
+		},
+		{
+			[]RelabelConfig{{Regex: "app", Action: RelabelLabelKeep}},
+			`http_requests_total{app="api"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"Path"}, TargetLabel: "path", Action: RelabelLowercase}},
+			`http_requests_total{app="api",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu",path="/users/42"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"app"}, TargetLabel: "app", Action: RelabelUppercase}},
+			`http_requests_total{app="API",Path="/Users/42",instance="10.0.0.1:9100",__meta_zone="eu"}`,
+		},
+		{
+			[]RelabelConfig{{SourceLabels: []string{"instance"}, TargetLabel: "shard", Modulus: 4, Action: RelabelHashMod}, {Regex: "shard|app", Action: RelabelLabelKeep}},
+			`http_requests_total{app="api",shard="1"}`,
+		},
+	} {
+		name, labels, keep := Relabel("http_requests_total", labelList, test.configs)
+		output := "dropped"
+		if keep {
+			output = name + FormatLabels(labels)
+		}
+		if output != test.expected {
+			t.Errorf("Receive %v for %+v; want %v", output, test.configs, test.expected)
+		}
+	}
+	if fmt.Sprint(labelList) != "[app api Path /Users/42 instance 10.0.0.1:9100 __meta_zone eu]" {
+		t.Errorf("Relabel modifies the input labels %v", labelList)
+	}
+}
+
+func relabelString(s string) *string {
+	return &s
+}
+
+func TestAnchoredRegexpsBound(t *testing.T) {
+	for i := 0; i < maxAnchoredRegexps*2; i++ {
+		if _, err := anchoredRegexp(fmt.Sprintf("bound_%v", i)); err != nil {
+			t.Fatalf("Receive %v; want nil", err)
+		}
+	}
+	anchoredRegexps.RLock()
+	defer anchoredRegexps.RUnlock()
+	if n := len(anchoredRegexps.regexps); n > maxAnchoredRegexps {
+		t.Errorf("Receive %v cached regexps; want at most %v", n, maxAnchoredRegexps)
+	}
+}
+
+func TestRelabelConfigValidate(t *testing.T) {
+	for _, rc := range []RelabelConfig{
+		{Regex: "(", TargetLabel: "a"},
+		{Action: RelabelReplace},
+		{Action: RelabelHashMod, TargetLabel: "shard"},
+		{Action: "rename"},
+	} {
+		if err := rc.Validate(); err == nil {
+			t.Errorf("Receive nil error for %+v", rc)
+		}
+	}
+
+	pd := NewPromData([]PromTarget{{Url: "http://127.0.0.1:1/metrics", MetricRelabelConfigs: []RelabelConfig{{Regex: "("}}}}, PromDataOpts{})
+	if err := pd.CollectTargets(); err == nil || !strings.Contains(err.Error(), "relabel config 0") {
+		t.Errorf("Receive %v; want relabel config error", err)
+	}
+}
+
+func TestCollectRelabeledTarget(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Join([]string{
+			"# HELP legacy_latency_seconds Latency.",
+			"# TYPE legacy_latency_seconds histogram",
+			`legacy_latency_seconds_bucket{user_id="1",le="+Inf"} 1`,
+			`legacy_latency_seconds_sum{user_id="1"} 0.5`,
+			`legacy_latency_seconds_count{user_id="1"} 1`,
+			"# TYPE debug_info gauge",
+			"debug_info 1",
+		}, "\n"))
+	}))
+	defer target.Close()
+
+	pd := NewPromData([]PromTarget{{
+		Url:         target.URL,
+		ExtraLabels: []string{`app="legacy"`},
+		MetricRelabelConfigs: []RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: "legacy_(.*)", TargetLabel: "__name__"},
+		},
+	}}, PromDataOpts{MetricRelabelConfigs: []RelabelConfig{
+		{Regex: "user_id", Action: RelabelLabelDrop},
+		{SourceLabels: []string{"__name__"}, Regex: "debug_.*", Action: RelabelDrop},
+	}})
+	if err := pd.CollectTargets(); err != nil {
+		t.Fatalf("Receive %v; want nil", err)
+	}
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{app="legacy",le="+Inf"} 1
+latency_seconds_sum{app="legacy"} 0.5
+latency_seconds_count{app="legacy"} 1
+`
+	if output := pd.ToString(); output != expected {
+		t.Errorf("Receive\n%v\nwant\n%v", output, expected)
+	}
+	if pd.TargetResults[0].Samples != 4 {
+		t.Errorf("Receive %v scraped samples; want 4", pd.TargetResults[0].Samples)
+	}
+}